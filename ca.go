@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/er1c-zh/digger/proxy"
+	"github.com/er1c-zh/digger/util"
+	"os"
+)
+
+// runCACommand handles `digger ca <sub-command>`.
+func runCACommand(d *proxy.Digger, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: digger ca rotate [-ecdsa] | digger ca show")
+		return 2
+	}
+	switch args[0] {
+	case "rotate":
+		fs := flag.NewFlagSet("ca rotate", flag.ContinueOnError)
+		useECDSA := fs.Bool("ecdsa", false, "generate an ECDSA P-256 key instead of RSA 4096")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		keyType := util.KeyTypeRSA
+		if *useECDSA {
+			keyType = util.KeyTypeECDSA
+		}
+		if err := util.RotateCA(d.ConfigDir, d.CACertPath, d.CAKeyPath, keyType); err != nil {
+			fmt.Fprintf(os.Stderr, "rotate root CA fail: %s\n", err.Error())
+			return 1
+		}
+		certPath, _ := util.CAPaths(d.ConfigDir, d.CACertPath, d.CAKeyPath)
+		fmt.Printf("new root CA written to %s\n", certPath)
+		fmt.Printf("fingerprint: %s\n", util.CAFingerprint())
+		fmt.Println("re-install it on every client, the previous CA is no longer used.")
+		return 0
+	case "show":
+		if err := util.LoadOrCreateCA(d.ConfigDir, d.CACertPath, d.CAKeyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "load root CA fail: %s\n", err.Error())
+			return 1
+		}
+		certPath, _ := util.CAPaths(d.ConfigDir, d.CACertPath, d.CAKeyPath)
+		fmt.Printf("root CA: %s\n", certPath)
+		fmt.Printf("fingerprint: %s\n", util.CAFingerprint())
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown ca command: %s\n", args[0])
+	return 2
+}
@@ -0,0 +1,118 @@
+// Package cassette records HTTP interactions of Go tests into cassette files
+// and replays them, so tests run without the real backend.
+//
+//	r, err := cassette.NewRecorder("testdata/api.json", cassette.ModeReplay)
+//	client := r.Client()
+//	...
+//	err = r.Stop()
+package cassette
+
+import (
+	"encoding/json"
+	"github.com/er1c-zh/digger/proxy"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// Version of the cassette format.
+const Version = 1
+
+// Cassette is what a cassette file holds, interactions are kept in recording order.
+type Cassette struct {
+	Version      int
+	Interactions []*Interaction
+}
+
+// Interaction is one request and the response it got.
+type Interaction struct {
+	Request  *proxy.RecordReq
+	Response *proxy.RecordResp
+	// ResponseBody keeps a body that is not valid UTF-8,
+	// readable bodies stay in Response.Body so cassettes diff well.
+	ResponseBody []byte `json:",omitempty"`
+}
+
+// body returns the raw response body.
+func (i *Interaction) body() []byte {
+	if i.ResponseBody != nil {
+		return i.ResponseBody
+	}
+	if i.Response.BodyOrigin != nil {
+		return i.Response.BodyOrigin
+	}
+	return []byte(i.Response.Body)
+}
+
+// Load reads the cassette at path.
+func Load(path string) (*Cassette, error) {
+	j, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err = json.Unmarshal(j, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes c to path, creating its directory.
+func (c *Cassette) Save(path string) error {
+	c.Version = Version
+	for _, i := range c.Interactions {
+		body := i.body()
+		i.ResponseBody = nil
+		i.Response.Body = ""
+		if utf8.Valid(body) {
+			i.Response.Body = string(body)
+		} else {
+			i.ResponseBody = body
+		}
+	}
+	j, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(j, '\n'), 0644)
+}
+
+// DefaultRedact are the headers whose values never reach a cassette.
+var DefaultRedact = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+}
+
+// Redacted replaces the values of redacted headers.
+const Redacted = "[REDACTED]"
+
+func redact(i *Interaction, headers []string) {
+	for _, name := range headers {
+		name = http.CanonicalHeaderKey(name)
+		if vs, ok := i.Request.Header[name]; ok {
+			i.Request.Header[name] = redactValues(vs)
+		}
+		if vs, ok := i.Response.Header[name]; ok {
+			i.Response.Header[name] = redactValues(vs)
+			if name == "Set-Cookie" {
+				i.Response.Cookies = nil
+			}
+		}
+	}
+}
+
+func redactValues(vs []string) []string {
+	out := make([]string, len(vs))
+	for i := range out {
+		out[i] = Redacted
+	}
+	return out
+}
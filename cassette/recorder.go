@@ -0,0 +1,234 @@
+package cassette
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/er1c-zh/digger/proxy"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Mode decides whether a Recorder asks the real backend.
+type Mode int
+
+const (
+	// ModeRecord sends every request to the backend and rewrites the cassette.
+	ModeRecord Mode = iota
+	// ModeReplay answers from the cassette only, unmatched requests fail.
+	ModeReplay
+	// ModeRecordNew answers from the cassette and records what it does not match.
+	ModeRecordNew
+)
+
+// ErrNoInteraction is returned in replay mode when nothing in the cassette matches.
+var ErrNoInteraction = errors.New("cassette: no interaction matches the request")
+
+// Matcher tells if the recorded i answers req, body is the request body.
+type Matcher func(req *http.Request, body []byte, i *Interaction) bool
+
+// MatchMethodURL compares method and URL, it is the default Matcher.
+func MatchMethodURL(req *http.Request, _ []byte, i *Interaction) bool {
+	return req.Method == i.Request.Method && req.URL.String() == i.Request.URL.String()
+}
+
+// MatchMethodURLBody compares the body too.
+func MatchMethodURLBody(req *http.Request, body []byte, i *Interaction) bool {
+	return MatchMethodURL(req, body, i) && bytes.Equal(body, i.Request.BodyOrigin)
+}
+
+// MatchHeaders returns a Matcher comparing method, URL and the named headers.
+func MatchHeaders(names ...string) Matcher {
+	return func(req *http.Request, body []byte, i *Interaction) bool {
+		if !MatchMethodURL(req, body, i) {
+			return false
+		}
+		for _, name := range names {
+			if req.Header.Get(name) != i.Request.Header.Get(name) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Recorder is an http.RoundTripper recording to and replaying from a cassette file.
+type Recorder struct {
+	// Transport does the real requests, default is http.DefaultTransport.
+	Transport http.RoundTripper
+	// Matcher picks the interaction answering a request, default is MatchMethodURL.
+	Matcher Matcher
+	// Redact are the headers kept out of the cassette, default is DefaultRedact.
+	Redact []string
+
+	mode     Mode
+	path     string
+	mtx      sync.Mutex
+	cassette *Cassette
+	used     []bool
+	dirty    bool
+}
+
+// NewRecorder opens the cassette at path, it must exist unless mode is ModeRecord.
+func NewRecorder(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{
+		Matcher: MatchMethodURL,
+		Redact:  DefaultRedact,
+		mode:    mode,
+		path:    path,
+	}
+	if mode == ModeRecord {
+		r.cassette = &Cassette{Version: Version}
+		return r, nil
+	}
+	c, err := Load(path)
+	if err != nil {
+		if mode == ModeRecordNew && os.IsNotExist(err) {
+			c = &Cassette{Version: Version}
+		} else {
+			return nil, err
+		}
+	}
+	if c.Version > Version {
+		return nil, fmt.Errorf("cassette %s is version %d, newer than %d", path, c.Version, Version)
+	}
+	r.cassette = c
+	r.used = make([]bool, len(c.Interactions))
+	return r, nil
+}
+
+// Client returns an http.Client using r.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// Stop writes the cassette if anything was recorded.
+func (r *Recorder) Stop() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	r.dirty = false
+	return r.cassette.Save(r.path)
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.mode != ModeRecord {
+		if i := r.match(req, body); i != nil {
+			return i.response(req), nil
+		}
+		if r.mode == ModeReplay {
+			return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, req.URL.String())
+		}
+	}
+	return r.record(req, body)
+}
+
+// match returns the first unused matching interaction, or the last matching one once all are used.
+func (r *Recorder) match(req *http.Request, body []byte) *Interaction {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var last *Interaction
+	for n, i := range r.cassette.Interactions {
+		if !r.Matcher(req, body, i) {
+			continue
+		}
+		if n < len(r.used) && !r.used[n] {
+			r.used[n] = true
+			return i
+		}
+		last = i
+	}
+	return last
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	out := req.WithContext(req.Context())
+	out.Header = make(http.Header, len(req.Header))
+	for k, vs := range req.Header {
+		out.Header[k] = append([]string(nil), vs...)
+	}
+	if req.Body != nil {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	out, recordReq, err := proxy.CaptureRequest(out)
+	if err != nil {
+		return nil, err
+	}
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	recordResp, err := proxy.CaptureResponse(resp)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// the request body is only read by the transport, keep it whatever it read
+	recordReq.BodyOrigin = body
+	// redaction must not touch the headers handed back to the caller
+	recordResp.Header = cloneHeader(recordResp.Header)
+	i := &Interaction{Request: recordReq, Response: recordResp}
+	redact(i, r.Redact)
+
+	r.mtx.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+	r.used = append(r.used, true)
+	r.dirty = true
+	r.mtx.Unlock()
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+// response rebuilds the recorded response for req.
+func (i *Interaction) response(req *http.Request) *http.Response {
+	body := i.body()
+	header := cloneHeader(i.Response.Header)
+	status := i.Response.Status
+	if status == "" {
+		status = strconv.Itoa(i.Response.StatusCode) + " " + http.StatusText(i.Response.StatusCode)
+	}
+	return &http.Response{
+		Status:        status,
+		StatusCode:    i.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		out[k] = append([]string(nil), vs...)
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package cassette
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	hits := 0
+	encodings := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		encodings[r.Header.Get("Accept-Encoding")] = true
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+		if r.URL.Path == "/bin" {
+			_, _ = w.Write([]byte{0xff, 0xfe})
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testdata", "api.json")
+
+	get := func(r *Recorder, p string) (string, error) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+p, strings.NewReader("ping"))
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Accept-Encoding", "identity")
+		resp, err := r.Client().Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	r, err := NewRecorder(path, ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/a", "/bin"} {
+		if _, err = get(r, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(encodings) != 1 || !encodings["identity"] {
+		t.Errorf("expect the request sent as is, server saw Accept-Encoding %v", encodings)
+	}
+	j, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(j), "secret") || strings.Contains(string(j), "Bearer") {
+		t.Errorf("cassette not redacted: %s", j)
+	}
+
+	r, err = NewRecorder(path, ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := get(r, "/a"); err != nil || body != "POST /a ping" {
+		t.Errorf("replay /a got %q, %v", body, err)
+	}
+	if body, err := get(r, "/bin"); err != nil || body != "POST /bin ping\xff\xfe" {
+		t.Errorf("replay /bin got %q, %v", body, err)
+	}
+	if _, err = get(r, "/new"); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("replay /new expect ErrNoInteraction, got %v", err)
+	}
+	if hits != 2 {
+		t.Errorf("replay reached the server, hits %d", hits)
+	}
+
+	r, err = NewRecorder(path, ModeRecordNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = get(r, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = get(r, "/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 3 {
+		t.Errorf("record new episodes expect 3 hits, got %d", hits)
+	}
+	c, err := Load(path)
+	if err != nil || len(c.Interactions) != 3 {
+		t.Errorf("expect 3 interactions, err %v", err)
+	}
+}
@@ -1,13 +1,38 @@
 package main
 
 import (
+	"flag"
 	"github.com/er1c-zh/digger/proxy"
 	boot "github.com/er1c-zh/go-now/go_boot"
 	"github.com/er1c-zh/go-now/log"
+	"os"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path of config.json, default is <config dir>/config.json")
+	configDir := flag.String("dir", "", "config dir holding config.json and the root CA")
+	flag.Parse()
+
+	if flag.Arg(0) == "passwd" {
+		os.Exit(runPasswdCommand(flag.Args()[1:]))
+	}
+
 	digger := proxy.NewDigger()
+	if *configDir != "" {
+		digger.ConfigDir = *configDir
+	}
+	if err := digger.LoadConfig(*configPath); err != nil {
+		log.Fatal("load config fail: %s", err.Error())
+		log.Flush()
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "ca" {
+		code := runCACommand(digger, flag.Args()[1:])
+		log.Flush()
+		os.Exit(code)
+	}
+
 	boot.RegisterExitHandlers(func() {
 		digger.GracefullyQuit()
 	})
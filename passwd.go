@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/er1c-zh/digger/proxy"
+	"os"
+	"strings"
+)
+
+// runPasswdCommand handles `digger passwd <name>`, it reads the password from stdin
+// and prints the line to add to the users file.
+func runPasswdCommand(args []string) int {
+	if len(args) != 1 || args[0] == "" || strings.ContainsAny(args[0], ": \t") {
+		fmt.Fprintln(os.Stderr, "usage: digger passwd <name> < password-file")
+		return 2
+	}
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintf(os.Stderr, "read password from stdin fail: %v\n", err)
+		return 1
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "empty password")
+		return 1
+	}
+	hash, err := proxy.HashPassword(password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hash password fail: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%s:%s\n", args[0], hash)
+	return 0
+}
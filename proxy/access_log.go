@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// AccessLogJSON writes an AccessEntry as JSON per line.
+	AccessLogJSON = "json"
+	// AccessLogCommon is the Common Log Format, AccessLogCombined adds referer and user agent.
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+
+	defaultAccessLogBackups = 5
+	clfTimeFormat           = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessLogConfig writes one line per finished exchange.
+type AccessLogConfig struct {
+	// Format is json, common, combined or a text/template over AccessEntry like
+	// "{{.Method}} {{.URL}} {{.Status}} {{.DurationMs}}", empty turns the log off.
+	Format string
+	// File receives the lines, empty or "-" is stdout.
+	File string
+	// MaxSizeMB rotates File once it grows past, 0 never rotates.
+	// MaxBackups rotated files are kept as File.1 (the newest), File.2 ..., default 5.
+	MaxSizeMB  int
+	MaxBackups int
+}
+
+// AccessEntry is what an access line tells about an exchange.
+type AccessEntry struct {
+	Time       time.Time
+	Client     string `json:",omitempty"`
+	User       string `json:",omitempty"`
+	RemoteAddr string
+	Method     string
+	URL        string
+	Proto      string
+	// Status is 0 when the exchange failed before a response.
+	Status int
+	// BytesIn are body bytes from the client, BytesOut body bytes to it.
+	BytesIn    int64
+	BytesOut   int64
+	DurationMs float64
+	Referer    string `json:",omitempty"`
+	UserAgent  string `json:",omitempty"`
+	Https      bool
+	Tunnel     bool   `json:",omitempty"`
+	Error      string `json:",omitempty"`
+	Fault      string `json:",omitempty"`
+	Local      string `json:",omitempty"`
+	Mock       string `json:",omitempty"`
+}
+
+func newAccessEntry(r *Record) AccessEntry {
+	e := AccessEntry{
+		Time:       r.TimeStart,
+		Client:     r.Client,
+		User:       r.User,
+		RemoteAddr: r.Req.RemoteAddr,
+		Method:     r.Req.Method,
+		URL:        r.URL(),
+		Proto:      r.Req.Proto,
+		BytesIn:    int64(len(r.Req.BodyOrigin)),
+		Referer:    r.Req.Header.Get("Referer"),
+		UserAgent:  r.Req.Header.Get("User-Agent"),
+		Https:      r.IsHttps,
+		Error:      r.Error,
+		Fault:      r.Fault,
+		Local:      r.Local,
+		Mock:       r.Mock,
+	}
+	if r.Resp != nil {
+		e.Status = r.Resp.StatusCode
+		e.BytesOut = int64(len(r.Resp.BodyOrigin))
+	}
+	if r.Tunnel != nil {
+		e.Tunnel = true
+		e.URL = r.Req.Host
+		e.Status = 200
+		e.BytesIn, e.BytesOut = r.Tunnel.BytesClientToServer, r.Tunnel.BytesServerToClient
+		e.DurationMs = float64(r.Tunnel.Duration) / float64(time.Millisecond)
+	} else if l := r.latency(); l > 0 {
+		e.DurationMs = float64(l) / float64(time.Millisecond)
+	}
+	return e
+}
+
+// clf formats e in the Common Log Format, with referer and user agent if combined.
+func (e *AccessEntry) clf(combined bool) string {
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	status, size := "-", "-"
+	if e.Status > 0 {
+		status = strconv.Itoa(e.Status)
+	}
+	if e.BytesOut > 0 {
+		size = strconv.FormatInt(e.BytesOut, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s",
+		clfField(host), clfField(e.User), e.Time.Format(clfTimeFormat),
+		e.Method, clfQuote(e.URL), e.Proto, status, size)
+	if combined {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", clfQuote(e.Referer), clfQuote(e.UserAgent))
+	}
+	return line
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
+
+func clfQuote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+type accessLog struct {
+	format   string
+	template *template.Template
+	mtx      sync.Mutex
+	out      io.Writer
+	// closed drops the lines of exchanges still finishing after shutdown
+	closed bool
+}
+
+func (a *accessLog) init(config AccessLogConfig) error {
+	a.format = config.Format
+	switch config.Format {
+	case "":
+		return nil
+	case AccessLogJSON, AccessLogCommon, AccessLogCombined:
+	default:
+		if !strings.Contains(config.Format, "{{") {
+			return fmt.Errorf("unknown format %q", config.Format)
+		}
+		t, err := template.New("access").Parse(config.Format)
+		if err != nil {
+			return err
+		}
+		a.template = t
+	}
+	if config.File == "" || config.File == "-" {
+		a.out = os.Stdout
+		return nil
+	}
+	backups := config.MaxBackups
+	if backups <= 0 {
+		backups = defaultAccessLogBackups
+	}
+	f := &rotatingFile{path: config.File, maxSize: int64(config.MaxSizeMB) << 20, maxBackups: backups}
+	if err := f.open(); err != nil {
+		return err
+	}
+	a.out = f
+	return nil
+}
+
+// write logs the access line of r.
+func (a *accessLog) write(r *Record) {
+	if a.format == "" || r.Req == nil {
+		return
+	}
+	e := newAccessEntry(r)
+	var line []byte
+	switch {
+	case a.template != nil:
+		buf := &bytes.Buffer{}
+		if err := a.template.Execute(buf, &e); err != nil {
+			log.Error("access log template fail: %s", err.Error())
+			return
+		}
+		line = buf.Bytes()
+	case a.format == AccessLogJSON:
+		line, _ = json.Marshal(&e)
+	default:
+		line = []byte(e.clf(a.format == AccessLogCombined))
+	}
+	line = append(line, '\n')
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.closed {
+		return
+	}
+	if _, err := a.out.Write(line); err != nil {
+		log.Error("write access log fail: %s", err.Error())
+	}
+}
+
+func (a *accessLog) close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if c, ok := a.out.(io.Closer); ok && a.out != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// rotatingFile appends to path and moves it to path.1 once it would grow past maxSize,
+// older files shift to path.2 and so on up to maxBackups. Callers serialize writes.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.f.Close(); err != nil {
+		log.Warn("close %s fail: %s", f.path, err.Error())
+	}
+	_ = os.Remove(f.path + "." + strconv.Itoa(f.maxBackups))
+	for i := f.maxBackups - 1; i > 0; i-- {
+		_ = os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		// keep appending to path rather than losing lines
+		log.Error("rotate %s fail: %s", f.path, err.Error())
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.f.Close()
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2024, 3, 1, 10, 4, 5, 0, time.UTC)
+	header := http.Header{}
+	header.Set("User-Agent", "curl/8.0")
+	record := &Record{
+		Req: &RecordReq{
+			Method: "GET", Host: "example.com", Proto: "HTTP/1.1", RemoteAddr: "10.0.0.2:5123", Header: header,
+			URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/a", RawQuery: "q=1"},
+		},
+		Resp:           &RecordResp{StatusCode: 200, BodyOrigin: []byte("hello")},
+		User:           "alice",
+		TimeStart:      start,
+		TimeRespFinish: start.Add(1500 * time.Microsecond),
+	}
+	failed := &Record{
+		Req:       &RecordReq{Method: "POST", Host: "down.com", Proto: "HTTP/1.1", Header: http.Header{}, URL: &url.URL{Scheme: "http", Host: "down.com", Path: "/"}},
+		Error:     "dial fail",
+		TimeStart: start,
+	}
+
+	for format, expect := range map[string][]string{
+		AccessLogCommon: {
+			`10.0.0.2 - alice [01/Mar/2024:10:04:05 +0000] "GET http://example.com/a?q=1 HTTP/1.1" 200 5`,
+			`- - - [01/Mar/2024:10:04:05 +0000] "POST http://down.com/ HTTP/1.1" - -`,
+		},
+		AccessLogCombined: {
+			`10.0.0.2 - alice [01/Mar/2024:10:04:05 +0000] "GET http://example.com/a?q=1 HTTP/1.1" 200 5 "-" "curl/8.0"`,
+			`- - - [01/Mar/2024:10:04:05 +0000] "POST http://down.com/ HTTP/1.1" - - "-" "-"`,
+		},
+		"{{.Method}} {{.URL}} {{.Status}} {{.DurationMs}}": {
+			"GET http://example.com/a?q=1 200 1.5",
+			"POST http://down.com/ 0 0",
+		},
+	} {
+		file := filepath.Join(dir, "access.log")
+		a := &accessLog{}
+		if err = a.init(AccessLogConfig{Format: format, File: file}); err != nil {
+			t.Fatal(err)
+		}
+		a.write(record)
+		a.write(failed)
+		_ = a.close()
+		// exchanges finishing after shutdown are dropped
+		a.write(record)
+		b, _ := ioutil.ReadFile(file)
+		_ = os.Remove(file)
+		if got := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(expect, "\n") {
+			t.Errorf("%s got\n%s", format, b)
+		}
+	}
+
+	if got := clfQuote(`a\"b` + "\n"); got != `a\\\"b\n` {
+		t.Errorf("unexpected quoting %s", got)
+	}
+
+	e := newAccessEntry(record)
+	j, _ := json.Marshal(&e)
+	var decoded AccessEntry
+	if err = json.Unmarshal(j, &decoded); err != nil || decoded.Status != 200 || decoded.BytesOut != 5 || decoded.User != "alice" {
+		t.Errorf("unexpected json line %s", j)
+	}
+
+	if err = (&accessLog{}).init(AccessLogConfig{Format: "apache"}); err == nil {
+		t.Errorf("expect an unknown format to fail")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "access.log")
+	f := &rotatingFile{path: path, maxSize: 10, maxBackups: 2}
+	if err = f.open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = f.Close()
+	for name, expect := range map[string]string{
+		path:        "line-4\n",
+		path + ".1": "line-3\n",
+		path + ".2": "line-2\n",
+	} {
+		if b, _ := ioutil.ReadFile(name); string(b) != expect {
+			t.Errorf("%s got %q", name, b)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expect at most 2 backups")
+	}
+}
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthConfig protects a shared digger, everything is open by default.
+type AuthConfig struct {
+	// UsersFile makes proxy traffic require Proxy-Authorization Basic credentials.
+	// It lists one "name:hash" per line, get the line from `digger passwd <name>`.
+	// Changes are picked up without a restart.
+	UsersFile string
+	// AdminTokens are the bearer tokens for digger's own pages like /history,
+	// empty leaves them open. The root CA pages are always open so clients can be set up.
+	AdminTokens []string
+	// Allow and Deny are CIDRs or IPs checked against the client address, Deny wins.
+	// An empty Allow lets in every client that is not denied.
+	Allow []string
+	Deny  []string
+}
+
+const (
+	// passwordHashScheme prefixes hashes in the users file: scheme$iterations$salt$key.
+	passwordHashScheme     = "pbkdf2-sha256"
+	passwordHashIterations = 100000
+	passwordSaltSize       = 16
+	passwordKeySize        = 32
+
+	// usersFileCheckInterval is how often the users file is checked for changes.
+	usersFileCheckInterval = 2 * time.Second
+)
+
+// HashPassword hashes password for the users file with PBKDF2-HMAC-SHA256 and a random salt.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordHashIterations, passwordKeySize)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword tells if password matches hash from HashPassword.
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, pbkdf2SHA256([]byte(password), salt, iterations, len(key))) == 1
+}
+
+// pbkdf2SHA256 derives a key as in RFC 8018 section 5.2 with HMAC-SHA256 as the PRF.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	u := make([]byte, 0, sha256.Size)
+	t := make([]byte, sha256.Size)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var i [4]byte
+		binary.BigEndian.PutUint32(i[:], block)
+		prf.Write(i[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+type auth struct {
+	config AuthConfig
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+
+	mtx          sync.Mutex
+	users        map[string]string
+	usersMod     time.Time
+	usersChecked time.Time
+	// verified caches Proxy-Authorization values that passed, hashing is slow on purpose
+	verified map[string]string
+}
+
+func (a *auth) init(config AuthConfig) error {
+	var err error
+	if a.allow, err = parseCIDRs(config.Allow); err != nil {
+		return err
+	}
+	if a.deny, err = parseCIDRs(config.Deny); err != nil {
+		return err
+	}
+	a.config = config
+	if config.UsersFile != "" {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		return a.loadUsers(time.Now())
+	}
+	return nil
+}
+
+// parseCIDRs parses CIDRs, a bare IP is a network of its own.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// loadUsers reads the users file if it changed since the last load, a.mtx must be held.
+func (a *auth) loadUsers(now time.Time) error {
+	a.usersChecked = now
+	info, err := os.Stat(a.config.UsersFile)
+	if err != nil {
+		return err
+	}
+	if a.users != nil && info.ModTime().Equal(a.usersMod) {
+		return nil
+	}
+	f, err := os.Open(a.config.UsersFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		ix := strings.IndexByte(text, ':')
+		if ix <= 0 {
+			return fmt.Errorf("%s:%d: expect name:hash", a.config.UsersFile, line)
+		}
+		users[text[:ix]] = text[ix+1:]
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	a.users = users
+	a.usersMod = info.ModTime()
+	a.verified = map[string]string{}
+	log.Info("loaded %d proxy users from %s", len(users), a.config.UsersFile)
+	return nil
+}
+
+// allowed checks the client address against Allow and Deny.
+func (a *auth) allowed(remoteAddr string) bool {
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var errProxyAuth = errors.New("proxy authentication required")
+
+// proxyUser returns who sent req, "" without a users file.
+func (a *auth) proxyUser(req *http.Request) (string, error) {
+	if a.config.UsersFile == "" {
+		return "", nil
+	}
+	credentials := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(credentials) < len(prefix) || !strings.EqualFold(credentials[:len(prefix)], prefix) {
+		return "", errProxyAuth
+	}
+
+	a.mtx.Lock()
+	if now := time.Now(); now.Sub(a.usersChecked) > usersFileCheckInterval {
+		if err := a.loadUsers(now); err != nil {
+			// keep the users loaded before
+			log.Error("reload users file fail: %s", err.Error())
+		}
+	}
+	if name, ok := a.verified[credentials]; ok {
+		a.mtx.Unlock()
+		return name, nil
+	}
+	users, usersMod := a.users, a.usersMod
+	a.mtx.Unlock()
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials[len(prefix):])
+	if err != nil {
+		return "", errProxyAuth
+	}
+	ix := strings.IndexByte(string(decoded), ':')
+	if ix < 0 {
+		return "", errProxyAuth
+	}
+	name, password := string(decoded[:ix]), string(decoded[ix+1:])
+	hash, ok := users[name]
+	if !ok || !checkPassword(hash, password) {
+		return "", errProxyAuth
+	}
+	a.mtx.Lock()
+	// users may have been reloaded while hashing, what was checked is stale then
+	if a.usersMod.Equal(usersMod) {
+		a.verified[credentials] = name
+	}
+	a.mtx.Unlock()
+	return name, nil
+}
+
+// admin tells if req may use digger's own pages.
+func (a *auth) admin(req *http.Request) bool {
+	if len(a.config.AdminTokens) == 0 {
+		return true
+	}
+	credentials := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(credentials) < len(prefix) || !strings.EqualFold(credentials[:len(prefix)], prefix) {
+		return false
+	}
+	token := []byte(strings.TrimSpace(credentials[len(prefix):]))
+	ok := false
+	for _, t := range a.config.AdminTokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// authorizeProxy answers 407 unless req carries valid proxy credentials and returns the user,
+// the credentials are used up here and not forwarded or recorded.
+func (d *Digger) authorizeProxy(w http.ResponseWriter, req *http.Request) (string, bool) {
+	user, err := d.auth.proxyUser(req)
+	req.Header.Del("Proxy-Authorization")
+	if err != nil {
+		log.Warn("proxy auth of %s fail: %s", req.RemoteAddr, err.Error())
+		w.Header().Set("Proxy-Authenticate", `Basic realm="digger"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return "", false
+	}
+	return user, true
+}
+
+// authorizeAdmin answers 401 unless req may use the admin page it asks for.
+func (d *Digger) authorizeAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if d.noProxyHandler.isPublic(req.URL.Path) || d.auth.admin(req) {
+		return true
+	}
+	log.Warn("admin auth of %s for %s fail", req.RemoteAddr, req.URL.Path)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="digger"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 section 11
+	for _, c := range []struct {
+		password, salt string
+		iterations     int
+		expect         string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		key := pbkdf2SHA256([]byte(c.password), []byte(c.salt), c.iterations, 64)
+		if got := hex.EncodeToString(key); got != c.expect {
+			t.Errorf("pbkdf2(%s, %s, %d) got %s", c.password, c.salt, c.iterations, got)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "s3cret") || checkPassword(hash, "s3cre") || checkPassword("plain", "plain") {
+		t.Errorf("checkPassword does not match HashPassword")
+	}
+	if other, _ := HashPassword("s3cret"); other == hash {
+		t.Errorf("expect a random salt")
+	}
+}
+
+func TestAuth_Allowed(t *testing.T) {
+	a := &auth{}
+	if err := a.init(AuthConfig{Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"10.0.0.7"}}); err != nil {
+		t.Fatal(err)
+	}
+	for addr, expect := range map[string]bool{
+		"10.1.2.3:5000":  true,
+		"10.0.0.7:5000":  false,
+		"192.168.1.1:80": false,
+		"[::1]:80":       true,
+		"bad":            false,
+	} {
+		if got := a.allowed(addr); got != expect {
+			t.Errorf("allowed(%s) got %v", addr, got)
+		}
+	}
+	if err := a.init(AuthConfig{Deny: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("expect an invalid CIDR to fail")
+	}
+}
+
+func TestAuth_ProxyUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users")
+	hash, _ := HashPassword("s3cret")
+	if err = ioutil.WriteFile(users, []byte("# team\nalice:"+hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &auth{}
+	if err = a.init(AuthConfig{UsersFile: users, AdminTokens: []string{"tok"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if _, err = a.proxyUser(req); err != errProxyAuth {
+		t.Errorf("expect errProxyAuth without credentials, got %v", err)
+	}
+	req.SetBasicAuth("alice", "wrong")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	if _, err = a.proxyUser(req); err != errProxyAuth {
+		t.Errorf("expect errProxyAuth with a wrong password, got %v", err)
+	}
+	req.SetBasicAuth("alice", "s3cret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	if name, err := a.proxyUser(req); err != nil || name != "alice" {
+		t.Errorf("expect alice, got %q %v", name, err)
+	}
+
+	// the file is read again once it changed
+	if err = ioutil.WriteFile(users, []byte("bob:"+hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(users, later, later)
+	a.usersChecked = time.Time{}
+	if _, err = a.proxyUser(req); err != errProxyAuth {
+		t.Errorf("expect alice removed, got %v", err)
+	}
+
+	if a.admin(req) {
+		t.Errorf("expect admin pages closed without a token")
+	}
+	req.Header.Set("Authorization", "Bearer tok")
+	if !a.admin(req) {
+		t.Errorf("expect admin pages open with the token")
+	}
+}
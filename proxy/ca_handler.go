@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/er1c-zh/digger/util"
+	"github.com/er1c-zh/go-now/log"
+	"html/template"
+	"net/http"
+	texttemplate "text/template"
+	"time"
+)
+
+// CAHost lets a client already configured to use digger open http://digger/ca
+// instead of typing the proxy address.
+const CAHost = "digger"
+
+func (d *Digger) registerCAHandlers() {
+	d.noProxyHandler.RegisterPublic("/", buildCAPageHandler())
+	d.noProxyHandler.RegisterPublic("/ca", buildCAPageHandler())
+	d.noProxyHandler.RegisterPublic("/ca.crt", buildCACertHandler())
+	d.noProxyHandler.RegisterPublic("/ca.der", buildCADERHandler())
+	d.noProxyHandler.RegisterPublic("/ca.mobileconfig", buildCAMobileConfigHandler())
+}
+
+func buildCACertHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		writeCAFile(writer, "application/x-x509-ca-cert", "digger-ca.crt",
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: util.CA.Certificate[0]}))
+	}
+}
+
+func buildCADERHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		writeCAFile(writer, "application/pkix-cert", "digger-ca.der", util.CA.Certificate[0])
+	}
+}
+
+func buildCAMobileConfigHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		buf := new(bytes.Buffer)
+		err := mobileConfigTemplate.Execute(buf, map[string]string{
+			"Cert":          base64.StdEncoding.EncodeToString(util.CA.Certificate[0]),
+			"CommonName":    util.CA.Leaf.Subject.CommonName,
+			"PayloadUUID":   newUUID(),
+			"ProfileUUID":   newUUID(),
+			"PayloadSuffix": util.CA.Leaf.SerialNumber.Text(16),
+		})
+		if err != nil {
+			log.Error("render mobileconfig fail: %s", err.Error())
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeCAFile(writer, "application/x-apple-aspen-config", "digger-ca.mobileconfig", buf.Bytes())
+	}
+}
+
+func buildCAPageHandler() func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		buf := new(bytes.Buffer)
+		err := caPageTemplate.Execute(buf, map[string]interface{}{
+			"CommonName":  util.CA.Leaf.Subject.CommonName,
+			"Fingerprint": util.CAFingerprint(),
+			"NotAfter":    util.CA.Leaf.NotAfter.Format(time.RFC1123),
+		})
+		if err != nil {
+			log.Error("render ca page fail: %s", err.Error())
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("content-type", "text/html; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err = writer.Write(buf.Bytes())
+		if err != nil {
+			log.Error("write ca page fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+func writeCAFile(writer http.ResponseWriter, contentType, name string, data []byte) {
+	writer.Header().Set("content-type", contentType)
+	writer.Header().Set("content-disposition", "attachment; filename=\""+name+"\"")
+	writer.WriteHeader(http.StatusOK)
+	_, err := writer.Write(data)
+	if err != nil {
+		log.Error("write %s fail: %s", name, err.Error())
+		return
+	}
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+var mobileConfigTemplate = texttemplate.Must(texttemplate.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>digger-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{html .CommonName}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.github.er1c-zh.digger.ca.{{.PayloadSuffix}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.PayloadUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{html .CommonName}}</string>
+	<key>PayloadIdentifier</key>
+	<string>com.github.er1c-zh.digger.{{.PayloadSuffix}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+var caPageTemplate = template.Must(template.New("ca").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Digger root CA</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 1em auto; padding: 0 1em; line-height: 1.5; }
+code { background: #f3f3f3; padding: 0 .2em; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Trust the Digger root CA</h1>
+<p>Digger decrypts HTTPS by signing certificates with this CA.
+Only install it on devices you use for development, and check the fingerprint first.</p>
+<ul>
+<li>Name: <code>{{.CommonName}}</code></li>
+<li>SHA-256 fingerprint: <code>{{.Fingerprint}}</code></li>
+<li>Expires: {{.NotAfter}}</li>
+</ul>
+<p>Download: <a href="/ca.crt">PEM (ca.crt)</a> · <a href="/ca.der">DER (ca.der)</a> · <a href="/ca.mobileconfig">iOS profile</a></p>
+
+<h2>iOS / iPadOS</h2>
+<ol>
+<li>Open this page in Safari and download the <a href="/ca.mobileconfig">iOS profile</a>.</li>
+<li>Settings → Profile Downloaded → Install.</li>
+<li>Settings → General → About → Certificate Trust Settings, enable full trust for the Digger CA.</li>
+</ol>
+
+<h2>Android</h2>
+<ol>
+<li>Download <a href="/ca.crt">ca.crt</a>.</li>
+<li>Settings → Security → Encryption &amp; credentials → Install a certificate → CA certificate.</li>
+<li>Apps targeting Android 7+ ignore user CAs unless their network security config trusts them; browsers are fine.</li>
+</ol>
+
+<h2>macOS</h2>
+<ol>
+<li>Download <a href="/ca.crt">ca.crt</a> and open it in Keychain Access.</li>
+<li>Open the certificate, expand Trust and choose Always Trust.</li>
+<li>Or: <code>sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain ca.crt</code></li>
+</ol>
+
+<h2>Windows</h2>
+<ol>
+<li>Download <a href="/ca.der">ca.der</a>, open it and choose Install Certificate → Local Machine → Trusted Root Certification Authorities.</li>
+<li>Or as administrator: <code>certutil -addstore -f ROOT ca.der</code></li>
+</ol>
+
+<h2>Linux</h2>
+<ol>
+<li>Debian/Ubuntu: <code>sudo cp ca.crt /usr/local/share/ca-certificates/digger.crt &amp;&amp; sudo update-ca-certificates</code></li>
+<li>Fedora/RHEL: <code>sudo cp ca.crt /etc/pki/ca-trust/source/anchors/digger.crt &amp;&amp; sudo update-ca-trust</code></li>
+</ol>
+
+<h2>Firefox</h2>
+<ol>
+<li>Firefox has its own store: Settings → Privacy &amp; Security → Certificates → View Certificates → Authorities → Import <a href="/ca.crt">ca.crt</a>, then tick "Trust this CA to identify websites".</li>
+</ol>
+</body>
+</html>
+`))
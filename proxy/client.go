@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ClientByIP tells clients apart by their address.
+	ClientByIP = "ip"
+	// ClientByUser uses the proxy user, see AuthConfig.UsersFile.
+	ClientByUser = "user"
+	// ClientByHeader prefixes an identity read from a request header, e.g. "header:X-Digger-Client".
+	// The header is not forwarded.
+	ClientByHeader = "header:"
+)
+
+// ClientConfig separates the traffic of teammates sharing one digger.
+type ClientConfig struct {
+	// Identity is ip (default), user or header:<Name>, every record keeps it in Client.
+	// A client without a user or the header is told by its address.
+	Identity string
+	// Scoped limits /history and its exports to the caller's records, and gives each client
+	// its own fault and map local rules and its own mock, tried before the shared ones from config.json.
+	// An admin token holder picks another client with ?client=, * is everyone and the shared rules.
+	// Throttling, auto passthrough and the TLS key log stay shared, only an admin token holder
+	// may change them then.
+	Scoped bool
+}
+
+func (c *ClientConfig) validate() error {
+	switch {
+	case c.Identity == "" || c.Identity == ClientByIP || c.Identity == ClientByUser:
+	case c.header() != "":
+	default:
+		return fmt.Errorf("unknown identity %q", c.Identity)
+	}
+	return nil
+}
+
+// header is the header naming the client, "" unless Identity is header:<Name>.
+func (c *ClientConfig) header() string {
+	if !strings.HasPrefix(c.Identity, ClientByHeader) {
+		return ""
+	}
+	return http.CanonicalHeaderKey(strings.TrimSpace(strings.TrimPrefix(c.Identity, ClientByHeader)))
+}
+
+type proxyUserKey struct{}
+
+// withProxyUser keeps the proxy user req authenticated as for the records of its exchanges.
+func withProxyUser(req *http.Request, user string) *http.Request {
+	if user == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), proxyUserKey{}, user))
+}
+
+func proxyUserOf(req *http.Request) string {
+	user, _ := req.Context().Value(proxyUserKey{}).(string)
+	return user
+}
+
+// clientOf tells who sent req, user is the proxy user it authenticated as.
+func (d *Digger) clientOf(req *http.Request, user string) string {
+	if name := d.Clients.header(); name != "" {
+		if v := req.Header.Get(name); v != "" {
+			return v
+		}
+	} else if d.Clients.Identity == ClientByUser && user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// scope is the client an admin request works on, "" is everyone and the shared rules.
+func (d *Digger) scope(req *http.Request) string {
+	if !d.Clients.Scoped {
+		return ""
+	}
+	if client := req.URL.Query().Get("client"); client != "" && len(d.Auth.AdminTokens) > 0 && d.auth.admin(req) {
+		if client == "*" {
+			return ""
+		}
+		return client
+	}
+	// with ClientByUser the pages are opened through the proxy, credentials come along then
+	user, _ := d.auth.proxyUser(req)
+	return d.clientOf(req, user)
+}
+
+// guardShared keeps callers without an admin token from changing what all clients share
+// when Clients.Scoped, changes tells if req would change it.
+func (d *Digger) guardShared(changes func(*http.Request) bool, h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if d.Clients.Scoped && changes(req) && !(len(d.Auth.AdminTokens) > 0 && d.auth.admin(req)) {
+			log.Warn("%s may not change the shared %s", req.RemoteAddr, req.URL.Path)
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("digger: shared by all clients, changing it takes an admin token\n"))
+			return
+		}
+		h(writer, req)
+	}
+}
+
+func isPost(req *http.Request) bool {
+	return req.Method == http.MethodPost
+}
+
+func anyRequest(*http.Request) bool {
+	return true
+}
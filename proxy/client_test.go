@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDigger_ScopedClients(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("client:" + r.Header.Get("X-Digger-Client")))
+	}))
+	defer upstream.Close()
+
+	d, stop := startTestDigger(t, func(d *Digger) {
+		d.Clients = ClientConfig{Identity: "header:X-Digger-Client", Scoped: true}
+	})
+	defer stop()
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	admin := "http://" + d.Addr().String()
+
+	do := func(method, u, who string, body []byte) (int, []byte) {
+		req, _ := http.NewRequest(method, u, bytes.NewReader(body))
+		req.Header.Set("X-Digger-Client", who)
+		c := client
+		if strings.HasPrefix(u, admin) {
+			// digger's own pages are asked directly
+			c = http.DefaultClient
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, b
+	}
+
+	// a fault posted by alice only hits alice
+	rules, _ := json.Marshal([]FaultRule{{Paths: []string{"/broken"}, Action: FaultStatus, Status: http.StatusTeapot}})
+	if code, _ := do(http.MethodPost, admin+"/faults", "alice", rules); code != http.StatusOK {
+		t.Fatalf("post faults got %d", code)
+	}
+	if code, _ := do(http.MethodGet, upstream.URL+"/broken", "alice", nil); code != http.StatusTeapot {
+		t.Errorf("expect alice's fault, got %d", code)
+	}
+	code, body := do(http.MethodGet, upstream.URL+"/broken", "bob", nil)
+	if code != http.StatusOK {
+		t.Errorf("expect bob unaffected, got %d", code)
+	}
+	if string(body) != "client:" {
+		t.Errorf("expect the identity header dropped, upstream saw %q", body)
+	}
+	if _, body = do(http.MethodGet, admin+"/faults", "bob", nil); string(body) != "null" {
+		t.Errorf("expect bob without rules, got %s", body)
+	}
+
+	// a mock loaded by bob only answers bob
+	if code, _ := do(http.MethodPost, admin+"/mock", "bob", []byte(`{"Unmatched":"404"}`)); code != http.StatusOK {
+		t.Fatalf("post mock got %d", code)
+	}
+	if code, _ := do(http.MethodGet, upstream.URL+"/new", "bob", nil); code != http.StatusNotFound {
+		t.Errorf("expect bob's mock, got %d", code)
+	}
+	if code, _ := do(http.MethodGet, upstream.URL+"/new", "alice", nil); code != http.StatusOK {
+		t.Errorf("expect alice unaffected by bob's mock, got %d", code)
+	}
+	if code, _ := do(http.MethodGet, admin+"/mock/stop", "bob", nil); code != http.StatusOK {
+		t.Fatalf("stop mock got %d", code)
+	}
+
+	// throttling is shared, it takes an admin token to change
+	if code, _ := do(http.MethodPost, admin+"/throttle", "alice", []byte(`{"Rules":[]}`)); code != http.StatusForbidden {
+		t.Errorf("expect a scoped client kept from the shared throttle, got %d", code)
+	}
+	if code, _ := do(http.MethodGet, admin+"/keylog/enable", "alice", nil); code != http.StatusForbidden {
+		t.Errorf("expect a scoped client kept from the key log of everyone, got %d", code)
+	}
+	if code, _ := do(http.MethodGet, admin+"/throttle", "alice", nil); code != http.StatusOK {
+		t.Errorf("expect the shared throttle readable, got %d", code)
+	}
+
+	// each sees only their own history
+	for who, expect := range map[string]int{"alice": 2, "bob": 2} {
+		_, body = do(http.MethodGet, admin+"/history", who, nil)
+		var records []Record
+		if err := json.Unmarshal(body, &records); err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != expect {
+			t.Errorf("%s expect %d records, got %d", who, expect, len(records))
+		}
+		for _, r := range records {
+			if r.Client != who {
+				t.Errorf("%s sees a record of %q", who, r.Client)
+			}
+		}
+	}
+}
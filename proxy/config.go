@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const ConfigFileName = "config.json"
+
+// LoadConfig overrides d's exported fields with the JSON object in path.
+// An empty path is config.json in d.ConfigDir, which may be missing so a fresh
+// installation runs with defaults. A path given explicitly must exist.
+func (d *Digger) LoadConfig(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(d.ConfigDir, ConfigFileName)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, d)
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDigger_LoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digger-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDigger(WithConfigDir(dir))
+	if err = d.LoadConfig(""); err != nil {
+		t.Errorf("expect a missing config.json in the config dir to be fine, got %v", err)
+	}
+	if err = d.LoadConfig(filepath.Join(dir, "typo.json")); err == nil {
+		t.Error("expect a missing explicit config to fail")
+	}
+
+	path := filepath.Join(dir, ConfigFileName)
+	if err = ioutil.WriteFile(path, []byte(`{"Port": 18080}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if d.Port != 18080 {
+		t.Errorf("expect Port from the config, got %d", d.Port)
+	}
+}
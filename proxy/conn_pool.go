@@ -2,12 +2,15 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"github.com/er1c-zh/go-now/log"
 	"net"
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +25,10 @@ func init() {
 type ConnAction struct {
 	URL      *url.URL
 	ForceNew bool
+	// TLSConfig is used for https, nil skips verification.
+	TLSConfig *tls.Config
+	// Throttle paces the conn, nil leaves it alone.
+	Throttle *ThrottleProfile
 }
 
 func (a ConnAction) GetKey() string {
@@ -31,109 +38,325 @@ func (a ConnAction) GetKey() string {
 type ConnPool interface {
 	GetOrCreate(action ConnAction) (net.Conn, error)
 	Put(net.Conn)
+	// CloseIdle closes the conns waiting in the pool.
+	CloseIdle()
+	// Close closes the idle conns and stops the pool, conns put back later are closed.
+	Close()
+	Configure(config PoolConfig)
+	Stats() PoolStats
+}
+
+// PoolConfig limits the upstream conns, zero fields keep the defaults.
+type PoolConfig struct {
+	// MaxIdlePerHost is how many idle conns are kept per host, extra ones are closed.
+	MaxIdlePerHost int
+	// MaxConns caps the open conns, idle ones are evicted first and then callers wait.
+	MaxConns int
+	// IdleTimeoutMs closes conns idle for longer.
+	IdleTimeoutMs int
+	// WaitTimeoutMs is how long a caller waits for a free conn under MaxConns.
+	WaitTimeoutMs int
+}
+
+var DefaultPoolConfig = PoolConfig{
+	MaxIdlePerHost: 8,
+	MaxConns:       512,
+	IdleTimeoutMs:  90 * 1000,
+	WaitTimeoutMs:  10 * 1000,
+}
+
+// PoolStats are the gauges and counters of a pool, shown in /statistics.
+type PoolStats struct {
+	Open    int64
+	Idle    int64
+	Running int64
+	// Hits are checkouts served by an idle conn, Misses dialed a new one.
+	Hits   int64
+	Misses int64
+	// Stale idle conns failed the liveness check on checkout.
+	Stale int64
+	// Evicted idle conns made room under the limits, Expired ones hit IdleTimeoutMs.
+	Evicted int64
+	Expired int64
+	Waits   int64
+	// TLSFailures are failed handshakes with upstreams.
+	TLSFailures int64
+}
+
+var errPoolExhausted = errors.New("conn pool exhausted")
+
+type idleConn struct {
+	conn  *c8n
+	since time.Time
 }
 
 type connPool struct {
-	idle    sync.Map
-	running sync.Map
-	mtx     sync.Mutex
+	mtx      sync.Mutex
+	config   PoolConfig
+	idle     map[string][]idleConn
+	slotFree *sync.Cond
+	stats    PoolStats
+	closed   bool
+	// stop ends reapLoop
+	stop chan struct{}
+
+	sessionCache tls.ClientSessionCache
 }
 
 func NewConnPool() ConnPool {
-	return &connPool{}
+	c := &connPool{
+		config:       DefaultPoolConfig,
+		idle:         map[string][]idleConn{},
+		stop:         make(chan struct{}),
+		sessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	c.slotFree = sync.NewCond(&c.mtx)
+	go c.reapLoop()
+	return c
 }
 
-func (c *connPool) GetOrCreate(action ConnAction) (net.Conn, error) {
-	if action.ForceNew {
-		log.Debug("GetOrCreate ForceNew == true")
-		return c.getNew(action)
-	}
+func (c *connPool) Configure(config PoolConfig) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
-	connListUntyped, ok := c.idle.Load(action.GetKey())
-	if !ok {
-		// create new c8n
-		_conn, err := c.getNew(action)
-		if err != nil {
-			log.Error("getNew fail: %s", err.Error())
-			return nil, err
-		}
-		log.Debug("GetOrCreate getNew")
-		connListUntyped = []connectionStore{_conn}
-	} else {
-		log.Debug("GetOrCreate re-use")
+	if config.MaxIdlePerHost > 0 {
+		c.config.MaxIdlePerHost = config.MaxIdlePerHost
 	}
-
-	connList, ok := connListUntyped.([]connectionStore)
-	if !ok {
-		log.Fatal("invalid connList")
-		panic("unexpected conn_pool value")
+	if config.MaxConns > 0 {
+		c.config.MaxConns = config.MaxConns
 	}
-	if len(connList) <= 0 {
-		log.Fatal("invalid connList")
-		panic("unexpected conn_pool value")
+	if config.IdleTimeoutMs > 0 {
+		c.config.IdleTimeoutMs = config.IdleTimeoutMs
 	}
-	var conn connectionStore
-	i := 0
-	for _, c := range connList {
-		if c == nil {
-			continue
+	if config.WaitTimeoutMs > 0 {
+		c.config.WaitTimeoutMs = config.WaitTimeoutMs
+	}
+}
+
+func (c *connPool) Stats() PoolStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	stats := c.stats
+	stats.Running = stats.Open - stats.Idle
+	return stats
+}
+
+func (c *connPool) GetOrCreate(action ConnAction) (net.Conn, error) {
+	if !action.ForceNew {
+		for {
+			conn := c.takeIdle(action.GetKey())
+			if conn == nil {
+				break
+			}
+			if conn.alive() {
+				conn.action.Throttle = action.Throttle
+				conn.throttle.SetProfile(action.Throttle)
+				c.count(&c.stats.Hits)
+				log.Debug("GetOrCreate re-use")
+				return conn, nil
+			}
+			log.Debug("GetOrCreate drop stale conn to %s", action.URL.Host)
+			c.count(&c.stats.Stale)
+			_ = conn.Close()
 		}
-		// todo: check is conn is alive
-		conn = c
-		i++
-		break
 	}
-	if conn == nil {
-		panic("unexpected conn is nil")
+	c.count(&c.stats.Misses)
+	conn, err := c.getNew(action)
+	if err != nil {
+		log.Error("getNew fail: %s", err.Error())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// takeIdle pops the most recently used idle conn of key, nil if there is none.
+func (c *connPool) takeIdle(key string) *c8n {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	list := c.idle[key]
+	if len(list) == 0 {
+		return nil
 	}
-	connList = connList[1:]
-	if len(connList) > 0 {
-		c.idle.Store(action.GetKey(), connList)
+	conn := list[len(list)-1].conn
+	if len(list) == 1 {
+		delete(c.idle, key)
 	} else {
-		c.idle.Delete(action.GetKey())
+		c.idle[key] = list[:len(list)-1]
 	}
-	c.running.Store(conn.GetKey(), conn)
-
-	return conn.(net.Conn), nil
+	c.stats.Idle--
+	return conn
 }
 
 func (c *connPool) Put(conn net.Conn) {
-	_conn, ok := conn.(connectionStore)
+	_conn, ok := conn.(*c8n)
 	if !ok {
 		return
 	}
-	if _conn.GetConnAction().ForceNew {
-		err := conn.Close()
-		if err != nil {
-			log.Warn("conn.Close() fail: %s", err.Error())
-		}
+	if _conn.GetConnAction().ForceNew || _conn.isClosed() {
+		_ = conn.Close()
 		return
 	}
-	k := _conn.GetKey()
+	k := _conn.GetIdleKey()
+	// idle conns are not throttled, so alive probes answer right away
+	_conn.throttle.SetProfile(nil)
 
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		_ = conn.Close()
+		return
+	}
+	list := c.idle[k]
+	if len(list) >= c.config.MaxIdlePerHost {
+		c.stats.Evicted++
+		c.mtx.Unlock()
+		_ = conn.Close()
+		return
+	}
+	c.idle[k] = append(list, idleConn{conn: _conn, since: time.Now()})
+	c.stats.Idle++
+	c.mtx.Unlock()
+}
+
+func (c *connPool) CloseIdle() {
+	for _, conn := range c.removeIdle(func(idleConn) bool { return true }) {
+		if err := conn.Close(); err != nil {
+			log.Warn("close idle conn fail: %s", err.Error())
+		}
+	}
+}
+
+func (c *connPool) Close() {
+	c.mtx.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.stop)
+	}
+	c.mtx.Unlock()
+	c.CloseIdle()
+}
+
+// removeIdle takes the idle conns matching drop out of the pool.
+func (c *connPool) removeIdle(drop func(idleConn) bool) []*c8n {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
+	var dropped []*c8n
+	for k, list := range c.idle {
+		kept := list[:0]
+		for _, ic := range list {
+			if drop(ic) {
+				dropped = append(dropped, ic.conn)
+			} else {
+				kept = append(kept, ic)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.idle, k)
+		} else {
+			c.idle[k] = kept
+		}
+	}
+	c.stats.Idle -= int64(len(dropped))
+	return dropped
+}
+
+// reap closes the conns idle since before now minus IdleTimeoutMs.
+func (c *connPool) reap(now time.Time) {
+	c.mtx.Lock()
+	deadline := now.Add(-time.Duration(c.config.IdleTimeoutMs) * time.Millisecond)
+	c.mtx.Unlock()
+	expired := c.removeIdle(func(ic idleConn) bool {
+		return ic.since.Before(deadline)
+	})
+	for _, conn := range expired {
+		_ = conn.Close()
+	}
+	if len(expired) > 0 {
+		c.mtx.Lock()
+		c.stats.Expired += int64(len(expired))
+		c.mtx.Unlock()
+		log.Debug("reap %d idle conns", len(expired))
+	}
+}
 
-	// del from running queue
-	_, ok = c.running.Load(k)
-	if ok {
-		c.running.Delete(k)
+func (c *connPool) reapLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			c.reap(now)
+		case <-c.stop:
+			return
+		}
 	}
+}
 
-	// append to idle queue
-	listUntyped, ok := c.idle.Load(_conn.GetIdleKey())
-	if !ok {
-		listUntyped = make([]connectionStore, 0, 1)
+// acquire books a slot for a new conn under MaxConns, evicting the oldest idle conn
+// or waiting up to WaitTimeoutMs when all are taken.
+func (c *connPool) acquire() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	timedOut := false
+	var timer *time.Timer
+	for c.stats.Open >= int64(c.config.MaxConns) {
+		if victim := c.oldestIdleLocked(); victim != nil {
+			c.stats.Evicted++
+			c.mtx.Unlock()
+			_ = victim.Close()
+			c.mtx.Lock()
+			continue
+		}
+		if timedOut {
+			return errPoolExhausted
+		}
+		if timer == nil {
+			c.stats.Waits++
+			timer = time.AfterFunc(time.Duration(c.config.WaitTimeoutMs)*time.Millisecond, func() {
+				c.mtx.Lock()
+				timedOut = true
+				c.mtx.Unlock()
+				c.slotFree.Broadcast()
+			})
+			defer timer.Stop()
+		}
+		c.slotFree.Wait()
 	}
-	list, ok := listUntyped.([]connectionStore)
-	if !ok {
-		panic("unexpected type")
+	c.stats.Open++
+	return nil
+}
+
+func (c *connPool) release() {
+	c.mtx.Lock()
+	c.stats.Open--
+	c.mtx.Unlock()
+	c.slotFree.Signal()
+}
+
+func (c *connPool) oldestIdleLocked() *c8n {
+	oldestKey := ""
+	var oldest idleConn
+	for k, list := range c.idle {
+		// lists are in put order, the first is the oldest
+		if oldest.conn == nil || list[0].since.Before(oldest.since) {
+			oldestKey, oldest = k, list[0]
+		}
+	}
+	if oldest.conn == nil {
+		return nil
+	}
+	if list := c.idle[oldestKey]; len(list) == 1 {
+		delete(c.idle, oldestKey)
+	} else {
+		c.idle[oldestKey] = list[1:]
 	}
-	list = append(list, _conn)
-	c.idle.Store(_conn.GetIdleKey(), list)
+	c.stats.Idle--
+	return oldest.conn
+}
 
-	return
+func (c *connPool) count(counter *int64) {
+	c.mtx.Lock()
+	*counter++
+	c.mtx.Unlock()
 }
 
 func (c *connPool) getNew(action ConnAction) (*c8n, error) {
@@ -148,35 +371,105 @@ func (c *connPool) getNew(action ConnAction) (*c8n, error) {
 			addr += ":80"
 		}
 	}
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	var info *TLSInfo
+	timing := &DialTiming{}
 	log.Debug("getNew Dial addr: %s", addr)
-	conn, err := net.Dial("tcp", addr)
+	conn, err := dialWithTiming(addr, timing)
 	if err != nil {
+		c.release()
 		return nil, err
 	}
+	// throttle below TLS, so the handshake is paced like the rest
+	throttled := &throttledConn{Conn: conn, upstream: true, profile: action.Throttle}
+	conn = throttled
 	if action.URL.Scheme == "https" {
-		tlsConn := tls.Client(conn, &tls.Config{
-			InsecureSkipVerify: true,
-		})
+		var config *tls.Config
+		if action.TLSConfig != nil {
+			config = action.TLSConfig.Clone()
+		} else {
+			config = &tls.Config{InsecureSkipVerify: true}
+		}
+		if config.ServerName == "" {
+			config.ServerName = action.URL.Hostname()
+		}
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = alpnProtos
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = c.sessionCache
+		}
+		tlsConn := tls.Client(conn, config)
+		timing.TLSStart = time.Now()
 		if err := tlsConn.Handshake(); err != nil {
 			log.Error("shake hand fail: %s", err.Error())
+			c.count(&c.stats.TLSFailures)
+			_ = conn.Close()
+			c.release()
 			return nil, err
 		}
+		timing.TLSDone = time.Now()
 		conn = tlsConn
+		info = newTLSInfo(tlsConn.ConnectionState(), config.ServerName)
 	}
 	_conn := &c8n{
-		conn:    conn,
-		r:       bufio.NewReader(conn),
-		key:     action.GetKey() + ":" + strconv.FormatInt(time.Now().UnixNano(), 10),
-		idleKey: action.GetKey(),
-		action:  action,
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		key:      action.GetKey() + ":" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		idleKey:  action.GetKey(),
+		action:   action,
+		tlsInfo:  info,
+		timing:   timing,
+		fresh:    true,
+		throttle: throttled,
+		pool:     c,
 	}
 	return _conn, nil
 }
 
+// dialWithTiming resolves and connects separately, so both phases can be timed.
+func dialWithTiming(addr string, timing *DialTiming) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		timing.DNSStart = time.Now()
+		addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+		timing.DNSDone = time.Now()
+		if err != nil {
+			return nil, err
+		}
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.IP.String())
+		}
+	}
+	timing.ConnectStart = time.Now()
+	defer func() {
+		timing.ConnectDone = time.Now()
+	}()
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
 type connectionStore interface {
 	GetConnAction() ConnAction
 	GetKey() string
 	GetIdleKey() string
+	GetTLSInfo() *TLSInfo
+	// TakeDialTiming returns how the conn was dialed to its first user only,
+	// later users get nil as they reuse it.
+	TakeDialTiming() *DialTiming
 }
 
 type c8n struct {
@@ -185,14 +478,62 @@ type c8n struct {
 	key     string
 	idleKey string
 	action  ConnAction
+	tlsInfo *TLSInfo
+	timing  *DialTiming
+	fresh   bool
+	// throttle is the raw conn under TLS.
+	throttle *throttledConn
+
+	pool      *connPool
+	closeOnce sync.Once
+	closed    int32
 }
 
 func (c *c8n) Write(b []byte) (n int, err error) {
 	return c.conn.Write(b)
 }
 
+// Close closes the conn and frees its slot in the pool, later calls do nothing.
 func (c *c8n) Close() error {
-	return c.conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		err = c.conn.Close()
+		c.pool.release()
+	})
+	return err
+}
+
+func (c *c8n) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// aliveProbe is how long alive waits for the peer, a deadline already passed
+// fails the read before it reaches the socket and would never see the EOF.
+const aliveProbe = time.Millisecond
+
+// alive peeks for a moment, an idle conn is alive if nothing is there yet.
+// EOF means the server closed it, unsolicited bytes (e.g. a 408) make it unusable too.
+func (c *c8n) alive() bool {
+	if c.r.Buffered() > 0 {
+		return false
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(aliveProbe)); err != nil {
+		return false
+	}
+	_, err := c.r.Peek(1)
+	_ = c.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Reader is the buffered reader of the conn, it must be the only one reading
+// so nothing buffered is lost when the conn goes back to the pool.
+func (c *c8n) Reader() *bufio.Reader {
+	return c.r
 }
 
 func (c *c8n) LocalAddr() net.Addr {
@@ -234,3 +575,15 @@ func (c *c8n) GetIdleKey() string {
 func (c *c8n) GetConnAction() ConnAction {
 	return c.action
 }
+
+func (c *c8n) GetTLSInfo() *TLSInfo {
+	return c.tlsInfo
+}
+
+func (c *c8n) TakeDialTiming() *DialTiming {
+	if !c.fresh {
+		return nil
+	}
+	c.fresh = false
+	return c.timing
+}
@@ -1,8 +1,12 @@
 package proxy
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestConnPool_GetOrCreate(t *testing.T) {
@@ -17,3 +21,112 @@ func TestConnPool_GetOrCreate(t *testing.T) {
 		return
 	}
 }
+
+func TestConnPool_Liveness(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	pool := NewConnPool()
+	defer pool.Close()
+	action := ConnAction{URL: &url.URL{Scheme: "http", Host: l.Addr().String()}}
+
+	conn, err := pool.GetOrCreate(action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSide := <-accepted
+	pool.Put(conn)
+	if conn, err = pool.GetOrCreate(action); err != nil {
+		t.Fatal(err)
+	}
+	if s := pool.Stats(); s.Hits != 1 || s.Misses != 1 || s.Open != 1 {
+		t.Errorf("reuse: unexpected stats %+v", s)
+	}
+
+	// the server side goes away while the conn is idle
+	pool.Put(conn)
+	_ = serverSide.Close()
+	time.Sleep(50 * time.Millisecond)
+	if conn, err = pool.GetOrCreate(action); err != nil {
+		t.Fatal(err)
+	}
+	if s := pool.Stats(); s.Stale != 1 || s.Misses != 2 || s.Open != 1 {
+		t.Errorf("stale: unexpected stats %+v", s)
+	}
+	_ = conn.Close()
+}
+
+func TestConnPool_Limits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	pool := NewConnPool()
+	defer pool.Close()
+	pool.Configure(PoolConfig{MaxIdlePerHost: 1, MaxConns: 2, WaitTimeoutMs: 50, IdleTimeoutMs: 1000})
+	action := ConnAction{URL: u}
+
+	a, _ := pool.GetOrCreate(action)
+	b, _ := pool.GetOrCreate(action)
+	if _, err := pool.GetOrCreate(action); err != errPoolExhausted {
+		t.Errorf("expect errPoolExhausted over MaxConns, got %v", err)
+	}
+	pool.Put(a)
+	pool.Put(b)
+	if s := pool.Stats(); s.Idle != 1 || s.Open != 1 || s.Evicted != 1 || s.Waits != 1 {
+		t.Errorf("max idle: unexpected stats %+v", s)
+	}
+
+	other, _ := url.Parse("http://" + u.Host + "/other")
+	other.Host = "localhost:" + other.Port()
+	c, err := pool.GetOrCreate(ConnAction{URL: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := pool.GetOrCreate(ConnAction{URL: other})
+	if err != nil {
+		t.Fatalf("expect the idle conn evicted for a new one, got %v", err)
+	}
+	pool.Put(c)
+	pool.Put(d)
+
+	pool.(*connPool).reap(time.Now().Add(2 * time.Second))
+	if s := pool.Stats(); s.Idle != 0 || s.Open != 0 || s.Expired != 1 {
+		t.Errorf("reap: unexpected stats %+v", s)
+	}
+}
+
+func TestConnPool_Close(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	pool := NewConnPool()
+	action := ConnAction{URL: u}
+
+	a, _ := pool.GetOrCreate(action)
+	b, _ := pool.GetOrCreate(action)
+	pool.Put(a)
+	pool.Close()
+	pool.Put(b)
+	if s := pool.Stats(); s.Idle != 0 || s.Open != 0 {
+		t.Errorf("expect no conns after Close, got %+v", s)
+	}
+	select {
+	case <-pool.(*connPool).stop:
+	default:
+		t.Errorf("expect the reaper stopped")
+	}
+	// closing again is fine
+	pool.Close()
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RecordDiff is what digger changed in transit of one record.
+type RecordDiff struct {
+	// Index is the position of the record in /history.
+	Index int
+	URL   string
+	// Local is set when digger answered itself, there is no upstream side to compare.
+	Local    bool         `json:",omitempty"`
+	Request  *MessageDiff `json:",omitempty"`
+	Response *MessageDiff `json:",omitempty"`
+}
+
+// MessageDiff compares a message as digger received it with the message as it forwarded it.
+type MessageDiff struct {
+	// Line is the changed request or status line, "before -> after".
+	Line   string       `json:",omitempty"`
+	Header []HeaderDiff `json:",omitempty"`
+	// Body is the size of a changed body, "before -> after bytes".
+	Body string `json:",omitempty"`
+}
+
+// HeaderDiff is a changed header, Before is empty if it was added and After if it was removed.
+type HeaderDiff struct {
+	Name   string
+	Before []string `json:",omitempty"`
+	After  []string `json:",omitempty"`
+}
+
+// diff compares both sides of r, nil if nothing changed.
+func (r *Record) diff(index int) *RecordDiff {
+	d := &RecordDiff{Index: index, URL: r.URL()}
+	if r.UpstreamReq == nil {
+		if r.Req == nil || r.Resp == nil {
+			return nil
+		}
+		d.Local = true
+		return d
+	}
+	d.Request = diffMessage(
+		requestLine(r.Req), requestLine(r.UpstreamReq),
+		r.Req.Header, r.UpstreamReq.Header,
+		r.Req.BodyOrigin, r.UpstreamReq.BodyOrigin,
+	)
+	if r.UpstreamResp != nil && r.Resp != nil {
+		d.Response = diffMessage(
+			statusLine(r.UpstreamResp), statusLine(r.Resp),
+			r.UpstreamResp.Header, r.Resp.Header,
+			r.UpstreamResp.BodyOrigin, r.Resp.BodyOrigin,
+		)
+	}
+	if d.Request == nil && d.Response == nil {
+		return nil
+	}
+	return d
+}
+
+func requestLine(r *RecordReq) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI() + " " + r.Proto
+}
+
+func statusLine(r *RecordResp) string {
+	return r.Proto + " " + r.Status
+}
+
+func diffMessage(lineBefore, lineAfter string, before, after http.Header, bodyBefore, bodyAfter []byte) *MessageDiff {
+	m := &MessageDiff{}
+	if lineBefore != lineAfter {
+		m.Line = lineBefore + " -> " + lineAfter
+	}
+	names := map[string]bool{}
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	for name := range names {
+		if strings.Join(before[name], "\n") != strings.Join(after[name], "\n") {
+			m.Header = append(m.Header, HeaderDiff{Name: name, Before: before[name], After: after[name]})
+		}
+	}
+	sort.Slice(m.Header, func(i, j int) bool {
+		return m.Header[i].Name < m.Header[j].Name
+	})
+	if !bytes.Equal(bodyBefore, bodyAfter) {
+		m.Body = fmt.Sprintf("%d -> %d bytes", len(bodyBefore), len(bodyAfter))
+	}
+	if m.Line == "" && len(m.Header) == 0 && m.Body == "" {
+		return nil
+	}
+	return m
+}
+
+// BuildDiffHandler lists what digger changed in each record, or in the one at ?index=.
+func (l *_recordList) BuildDiffHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		records := l.snapshotOf(scope(req))
+		diffs := []*RecordDiff{}
+		if v := req.URL.Query().Get("index"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 || i >= len(records) {
+				writer.WriteHeader(http.StatusNotFound)
+				_, _ = writer.Write([]byte("no record at index " + v))
+				return
+			}
+			if d := records[i].diff(i); d != nil {
+				diffs = append(diffs, d)
+			}
+		} else {
+			for i := range records {
+				if d := records[i].diff(i); d != nil {
+					diffs = append(diffs, d)
+				}
+			}
+		}
+		j, _ := json.Marshal(diffs)
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("diff write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRecord_Diff(t *testing.T) {
+	u, _ := url.Parse("http://example.com/a?b=1")
+	req := &RecordReq{
+		Method: http.MethodPost, URL: u, Host: "example.com", Proto: "HTTP/1.0",
+		Header:     http.Header{"Accept-Encoding": {"gzip"}, "X-Same": {"1"}},
+		BodyOrigin: []byte("body"),
+	}
+	upstreamReq := &RecordReq{
+		Method: http.MethodPost, URL: u, Host: "example.com", Proto: "HTTP/1.1",
+		Header:     http.Header{"X-Same": {"1"}, "Via": {"1.0 digger"}},
+		BodyOrigin: []byte("body"),
+	}
+	upstreamResp := &RecordResp{
+		Proto: "HTTP/1.1", Status: "200 OK",
+		Header:     http.Header{"X-Seen": {"upstream"}},
+		BodyOrigin: []byte("hello"),
+	}
+	resp := &RecordResp{
+		Proto: "HTTP/1.1", Status: "200 OK",
+		Header:     http.Header{"X-Seen": {"hook"}},
+		BodyOrigin: []byte("hel"),
+	}
+	r := &Record{Req: req, UpstreamReq: upstreamReq, UpstreamResp: upstreamResp, Resp: resp}
+
+	expect := &RecordDiff{
+		Index: 3,
+		URL:   "http://example.com/a?b=1",
+		Request: &MessageDiff{
+			Line: "POST example.com/a?b=1 HTTP/1.0 -> POST example.com/a?b=1 HTTP/1.1",
+			Header: []HeaderDiff{
+				{Name: "Accept-Encoding", Before: []string{"gzip"}},
+				{Name: "Via", After: []string{"1.0 digger"}},
+			},
+		},
+		Response: &MessageDiff{
+			Header: []HeaderDiff{{Name: "X-Seen", Before: []string{"upstream"}, After: []string{"hook"}}},
+			Body:   "5 -> 3 bytes",
+		},
+	}
+	if got := r.diff(3); !reflect.DeepEqual(got, expect) {
+		t.Errorf("diff got %+v, expect %+v", got, expect)
+	}
+
+	upstreamReq.Proto = "HTTP/1.0"
+	upstreamReq.Header = req.Header
+	resp.Header = upstreamResp.Header
+	resp.BodyOrigin = upstreamResp.BodyOrigin
+	if got := r.diff(3); got != nil {
+		t.Errorf("expect no diff for an unchanged exchange, got %+v", got)
+	}
+
+	r = &Record{Req: req, Resp: resp}
+	if got := r.diff(0); got == nil || !got.Local {
+		t.Errorf("expect a local answer marked Local, got %+v", got)
+	}
+}
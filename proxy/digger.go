@@ -1,8 +1,15 @@
 package proxy
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/er1c-zh/digger/util"
 	"github.com/er1c-zh/go-now/log"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,53 +19,300 @@ type Digger struct {
 	Address     string
 	Port        int16
 	HistorySize int64
+	// HistoryFile receives the history as JSON on shutdown if not empty.
+	HistoryFile string
+
+	// Pool limits the upstream conns, see DefaultPoolConfig.
+	Pool PoolConfig
+	// Summary is the periodic log line, /metrics has the details for Prometheus.
+	Summary SummaryConfig
+	// AccessLog writes a line per exchange, it is off by default.
+	AccessLog AccessLogConfig
+
+	// Forward adds Via, Forwarded and X-Forwarded-For to forwarded messages, all are off by default.
+	Forward ForwardHeaders
+
+	// Auth adds proxy users, admin tokens and client address lists.
+	Auth AuthConfig
+	// Clients tells teammates sharing digger apart and can scope history and rules to each.
+	Clients ClientConfig
+
+	// ConfigDir holds config.json and the root CA, see util.DefaultConfigDir.
+	ConfigDir string
+	// CACertPath and CAKeyPath override where the root CA is loaded from.
+	CACertPath string
+	CAKeyPath  string
+
+	// CertCacheSize limits how many MITM certificates are kept in memory.
+	CertCacheSize int
+	// CertCacheDir persists MITM certificates across runs if not empty.
+	CertCacheDir string
+
+	// MitmInclude limits interception to matching hosts if not empty,
+	// MitmExclude hosts are always tunneled untouched. See hostPatterns.
+	MitmInclude []string
+	MitmExclude []string
+	// AutoPassthroughThreshold is how many failed client handshakes in a row
+	// switch a host to passthrough, 0 disables it.
+	AutoPassthroughThreshold int
+
+	// UpstreamVerify is how server certificates are checked when no UpstreamTLS rule matches.
+	UpstreamVerify string
+	// UpstreamTLS rules are matched in order, the first matching one wins.
+	UpstreamTLS []UpstreamTLSRule
+
+	// KeyLogFile receives NSS key log lines of every TLS connection, default is $SSLKEYLOGFILE.
+	// Toggle it at runtime with /keylog/enable and /keylog/disable.
+	KeyLogFile string
+
+	// Throttle rules pick a profile per host, ThrottleProfiles adds to or
+	// overrides the builtin ones. Change them at runtime with POST /throttle.
+	Throttle         []ThrottleRule
+	ThrottleProfiles map[string]ThrottleProfile
+
+	// Faults are matched in order, the first matching one whose probability hits
+	// is injected. Change them at runtime with POST /faults.
+	Faults []FaultRule
+
+	// MapLocal rules serve matching requests from local files or directories,
+	// change them at runtime with POST /maplocal.
+	MapLocal []MapLocalRule
+
+	// Mock answers requests with recorded responses from its Session at start,
+	// load, stop or rewind it at runtime with /mock, /mock/stop and /mock/rewind.
+	Mock *MockConfig
 
 	done     chan struct{}
+	doneOnce sync.Once
 	initOnce sync.Once
+	initErr  error
+	// summaryOnce starts the summary log once
+	summaryOnce sync.Once
 
-	s statistics
+	mtx      sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	stopped  chan struct{}
+	hooks    []Hook
+	hijacked hijackTracker
+
+	s       Statistics
+	metrics *metrics
 
 	noProxyHandler *noProxyHandler
+	certCache      *util.CertCache
+	passthrough    passthrough
+	upstreamTLS    []upstreamTLS
+	ticketKeys     [][32]byte
+	keyLog         keyLogWriter
+	throttle       throttle
+	faults         faults
+	mapLocal       mapLocal
+	mock           mock
+	auth           auth
+	accessLog      accessLog
 
 	history _recordList
-	running []_record
+	running []Record
 }
 
-func NewDigger() *Digger {
-	return &Digger{
-		Address: "0.0.0.0",
-		Port:    8080,
+// NewDigger returns a Digger with defaults, opts and LoadConfig change them before Start.
+func NewDigger(opts ...Option) *Digger {
+	d := &Digger{
+		Address:                  "0.0.0.0",
+		Port:                     8080,
+		ConfigDir:                util.DefaultConfigDir(),
+		CertCacheSize:            util.DefaultCertCacheSize,
+		AutoPassthroughThreshold: DefaultAutoPassthroughThreshold,
+		UpstreamVerify:           UpstreamVerifySystem,
+		KeyLogFile:               os.Getenv("SSLKEYLOGFILE"),
+
 		done:    make(chan struct{}),
-		s: statistics{
+		stopped: make(chan struct{}),
+		s: Statistics{
 			CurrentConnCnt: 0,
 		},
+		metrics:        newMetrics(),
 		noProxyHandler: NewNoProxyHandler(),
 		history:        newRecordList(),
+		passthrough:    newPassthrough(),
+		ticketKeys:     newTicketKeys(),
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
+// GracefullyQuit shuts d down within DefaultShutdownTimeout.
 func (d *Digger) GracefullyQuit() {
-	close(d.done)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != nil {
+		log.Warn("shutdown fail: %s", err.Error())
+	}
 	log.Info("GracefullyQuit!")
 	return
 }
 
-func (d *Digger) Run() {
+// init prepares everything Start needs once, the error is kept for later calls.
+func (d *Digger) init() error {
 	d.initOnce.Do(func() {
-		d.LogStatisticsInfoPerSecond()
-		d.noProxyHandler.Register("/statistics", d.s.BuildHandler())
-		d.noProxyHandler.Register("/history", d.history.BuildHandler())
-		d.noProxyHandler.Register("/history/clean", d.history.BuildCleanHandler())
+		if err := util.LoadOrCreateCA(d.ConfigDir, d.CACertPath, d.CAKeyPath); err != nil {
+			d.initErr = fmt.Errorf("load root CA fail: %s", err.Error())
+			return
+		}
+		log.Info("root CA fingerprint: %s", util.CAFingerprint())
+		if err := d.auth.init(d.Auth); err != nil {
+			d.initErr = fmt.Errorf("load auth config fail: %s", err.Error())
+			return
+		}
+		if err := d.accessLog.init(d.AccessLog); err != nil {
+			d.initErr = fmt.Errorf("open access log fail: %s", err.Error())
+			return
+		}
+		if err := d.Summary.validate(); err != nil {
+			d.initErr = fmt.Errorf("summary config invalid: %s", err.Error())
+			return
+		}
+		if err := d.Clients.validate(); err != nil {
+			d.initErr = fmt.Errorf("clients config invalid: %s", err.Error())
+			return
+		}
+		d.keyLog.path = d.KeyLogFile
+		d.keyLog.SetEnabled(d.KeyLogFile != "")
+		if err := d.buildUpstreamTLS(); err != nil {
+			d.initErr = fmt.Errorf("load upstream tls config fail: %s", err.Error())
+			return
+		}
+		d.throttle.init(d.Throttle, d.ThrottleProfiles)
+		for i, rule := range d.Faults {
+			if err := rule.validate(); err != nil {
+				d.initErr = fmt.Errorf("fault rule %d invalid: %s", i, err.Error())
+				return
+			}
+		}
+		d.faults.init(d.Faults)
+		d.mapLocal.init(d.MapLocal)
+		if d.Mock != nil {
+			cnt, err := d.mock.load("", *d.Mock, nil)
+			if err != nil {
+				d.initErr = fmt.Errorf("load mock fail: %s", err.Error())
+				return
+			}
+			log.Info("mock loaded %d records", cnt)
+		}
+		DefaultConnPool.Configure(d.Pool)
+		d.certCache = util.NewCertCache(d.CertCacheSize, d.CertCacheDir)
+		d.LogSummary()
+		d.noProxyHandler.Register("/statistics", d.BuildStatisticsHandler())
+		d.noProxyHandler.Register("/metrics", d.BuildMetricsHandler())
+		d.noProxyHandler.Register("/history", d.history.BuildHandler(d.scope))
+		d.noProxyHandler.Register("/history/clean", d.history.BuildCleanHandler(d.scope))
+		d.noProxyHandler.Register("/history/diff", d.history.BuildDiffHandler(d.scope))
+		d.noProxyHandler.Register("/history.pcapng", d.history.BuildPcapngHandler(d.scope))
+		d.noProxyHandler.Register("/history.har", d.history.BuildHarHandler(d.scope))
+		d.noProxyHandler.Register("/stats/hosts", d.history.BuildStatsHandler(StatsByHost, d.scope))
+		d.noProxyHandler.Register("/stats/endpoints", d.history.BuildStatsHandler(StatsByEndpoint, d.scope))
+		d.noProxyHandler.Register("/stats/status", d.history.BuildStatsHandler(StatsByStatus, d.scope))
+		d.noProxyHandler.Register("/passthrough", d.passthrough.BuildHandler())
+		d.noProxyHandler.Register("/passthrough/clean", d.guardShared(anyRequest, d.passthrough.BuildCleanHandler()))
+		d.noProxyHandler.Register("/keylog", d.keyLog.BuildHandler())
+		d.noProxyHandler.Register("/keylog/enable", d.guardShared(anyRequest, d.keyLog.BuildToggleHandler(true)))
+		d.noProxyHandler.Register("/keylog/disable", d.guardShared(anyRequest, d.keyLog.BuildToggleHandler(false)))
+		d.noProxyHandler.Register("/throttle", d.guardShared(isPost, d.throttle.BuildHandler()))
+		d.noProxyHandler.Register("/faults", d.faults.BuildHandler(d.scope))
+		d.noProxyHandler.Register("/maplocal", d.mapLocal.BuildHandler(d.scope))
+		d.noProxyHandler.Register("/mock", d.mock.BuildHandler(&d.history, d.scope))
+		d.noProxyHandler.Register("/mock/stop", d.mock.BuildStopHandler(d.scope))
+		d.noProxyHandler.Register("/mock/rewind", d.mock.BuildRewindHandler(d.scope))
+		d.registerCAHandlers()
 
-		log.Info("Digger running!")
+	})
+	return d.initErr
+}
 
-		err := http.ListenAndServe(d.Address+":"+strconv.FormatInt(int64(d.Port), 10), d)
-		if err != nil {
-			log.Fatal("ListenAndServe fail: %s", err.Error())
-			return
+// Start listens and serves in the background, ctx only bounds starting up.
+// Stop it with Shutdown.
+func (d *Digger) Start(ctx context.Context) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.server != nil {
+		return errors.New("digger already started")
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", net.JoinHostPort(d.Address, strconv.FormatInt(int64(d.Port), 10)))
+	if err != nil {
+		return err
+	}
+	d.listener = l
+	d.server = &http.Server{
+		Handler:     d,
+		ConnContext: withClientConn,
+	}
+	go func() {
+		defer close(d.stopped)
+		err := d.server.Serve(&throttleListener{Listener: l})
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("Serve fail: %s", err.Error())
 		}
-		return
+	}()
+	log.Info("Digger running on %s", l.Addr().String())
+	return nil
+}
+
+// Addr is where d listens, nil before Start. Use it with Port 0.
+func (d *Digger) Addr() net.Addr {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.listener == nil {
+		return nil
+	}
+	return d.listener.Addr()
+}
+
+// Shutdown closes the listener and waits for in-flight requests and MITM connections
+// until ctx is done, what is left then is closed. Tunnels are closed right away.
+// Idle upstream conns and the access log are closed and the history is written to HistoryFile.
+func (d *Digger) Shutdown(ctx context.Context) error {
+	d.mtx.Lock()
+	server := d.server
+	d.mtx.Unlock()
+	d.doneOnce.Do(func() {
+		close(d.done)
 	})
+	if server == nil {
+		return nil
+	}
+	// MITM conns waiting for the next request and tunnels go now, busy ones after their exchange
+	d.hijacked.closeIdle()
+	err := server.Shutdown(ctx)
+	if e := d.hijacked.wait(ctx); err == nil {
+		err = e
+	}
+	DefaultConnPool.CloseIdle()
+	if e := d.accessLog.close(); e != nil {
+		log.Error("close access log fail: %s", e.Error())
+	}
+	if e := d.flushHistory(); e != nil {
+		log.Error("flush history fail: %s", e.Error())
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Run starts d and blocks until it is shut down.
+func (d *Digger) Run() {
+	if err := d.Start(context.Background()); err != nil {
+		log.Fatal("start fail: %s", err.Error())
+		return
+	}
+	<-d.stopped
 }
 
 func (d *Digger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -66,15 +320,35 @@ func (d *Digger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer func() {
 		d.MinusCurConn()
 	}()
+	if !d.auth.allowed(req.RemoteAddr) {
+		log.Warn("client %s denied", req.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	if req.Method == "CONNECT" {
+		user, ok := d.authorizeProxy(w, req)
+		if !ok {
+			return
+		}
+		req = withProxyUser(req, user)
+		d.throttleClient(req)
 		d.BuildHttpsHandler()(w, req)
 		log.Debug("return from https handler: %s", req.URL.String())
 		return
 	} else {
-		if !req.URL.IsAbs() {
+		if !req.URL.IsAbs() || stripPort(req.URL.Host) == CAHost {
+			if !d.authorizeAdmin(w, req) {
+				return
+			}
 			d.noProxyHandler.ServeHTTP(w, req)
 			return
 		} else {
+			user, ok := d.authorizeProxy(w, req)
+			if !ok {
+				return
+			}
+			req = withProxyUser(req, user)
+			d.throttleClient(req)
 			d.BuildHttpHandler()(w, req)
 			return
 		}
@@ -88,3 +362,11 @@ func stripPort(s string) string {
 	}
 	return s[:ix]
 }
+
+func newTicketKeys() [][32]byte {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		log.Error("generate session ticket key fail: %s", err.Error())
+	}
+	return [][32]byte{key}
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/er1c-zh/digger/util"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testHook struct {
+	BaseHook
+	records int32
+}
+
+func (h *testHook) OnRequest(req *http.Request) *http.Response {
+	req.Header.Set("X-Hooked", "1")
+	if req.URL.Path == "/local" {
+		return newTextResponse(req, http.StatusTeapot, "from hook")
+	}
+	return nil
+}
+
+func (h *testHook) OnResponse(resp *http.Response) {
+	resp.Header.Set("X-Seen", resp.Request.URL.Path)
+}
+
+func (h *testHook) OnRecord(Record) {
+	atomic.AddInt32(&h.records, 1)
+}
+
+func TestDigger_StartShutdown(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("upstream " + r.Header.Get("X-Hooked")))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hook := &testHook{}
+	d := NewDigger(
+		WithAddress("127.0.0.1", 0),
+		WithConfigDir(dir),
+		WithUpstreamVerify(UpstreamVerifySkip),
+		WithHook(hook),
+	)
+	d.HistoryFile = filepath.Join(dir, "history.json")
+	if err = d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(util.CA.Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	for target, expect := range map[string]string{
+		plain.URL + "/a":      "200 upstream 1 /a",
+		secure.URL + "/b":     "200 upstream 1 /b",
+		secure.URL + "/local": "418 from hook /local",
+	} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("get %s: %s", target, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		got := resp.Status[:3] + " " + string(body) + " " + resp.Header.Get("X-Seen")
+		if got != expect {
+			t.Errorf("get %s got %q, expect %q", target, got, expect)
+		}
+	}
+
+	// idle keep-alive conns, also the hijacked MITM one, must not hold up Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Shutdown took %s with idle conns", time.Since(start))
+	}
+	if j, err := ioutil.ReadFile(d.HistoryFile); err != nil || !strings.Contains(string(j), "/local") {
+		t.Errorf("history not flushed: %v", err)
+	}
+	// records of the MITM loop are added after the response is written
+	for i := 0; i < 100 && atomic.LoadInt32(&hook.records) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&hook.records); n != 3 || len(d.History()) != 3 {
+		t.Errorf("expect 3 records, hook got %d, history %d", n, len(d.History()))
+	}
+	if _, err = client.Get(plain.URL); err == nil {
+		t.Errorf("proxy still serving after Shutdown")
+	}
+}
+
+func TestDigger_ShutdownTunnel(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer secure.Close()
+	hook := &testHook{}
+	d, stop := startTestDigger(t, WithHook(hook), func(d *Digger) {
+		d.MitmExclude = []string{"127.0.0.1"}
+	})
+	defer stop()
+	d.HistoryFile = filepath.Join(d.ConfigDir, "history.json")
+
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(secure.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	// the keep-alive tunnel is closed, not waited for
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err = d.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Shutdown took %s with an open tunnel", time.Since(start))
+	}
+	if j, err := ioutil.ReadFile(d.HistoryFile); err != nil || !strings.Contains(string(j), `"Tunnel":{`) {
+		t.Errorf("expect the tunnel in the flushed history: %v", err)
+	}
+	if n := atomic.LoadInt32(&hook.records); n != 1 {
+		t.Errorf("expect the hook to see the tunnel, got %d records", n)
+	}
+}
+
+func TestDigger_HttpsIdleTunnelReleasesUpstream(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer secure.Close()
+	d, stop := startTestDigger(t, WithUpstreamVerify(UpstreamVerifySkip))
+	defer stop()
+
+	before := DefaultConnPool.Stats()
+	client := newMITMClient(d)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(secure.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+	}
+	for i := 0; i < 100 && len(d.History()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the tunnel is still open, its upstream conn waits in the pool and is reused
+	after := DefaultConnPool.Stats()
+	if after.Running != before.Running || after.Hits != before.Hits+1 {
+		t.Errorf("expect the conn back in the pool between requests, before %+v after %+v", before, after)
+	}
+}
+
+// newMITMClient sends requests through d trusting its root CA.
+func newMITMClient(d *Digger) *http.Client {
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(util.CA.Leaf)
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+}
+
+// startTestDigger starts a Digger on a random port with its config in a temp dir.
+func startTestDigger(t *testing.T, opts ...Option) (*Digger, func()) {
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]Option{WithAddress("127.0.0.1", 0), WithConfigDir(dir)}, opts...)
+	d := NewDigger(opts...)
+	if err = d.Start(context.Background()); err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return d, func() {
+		_ = d.Shutdown(context.Background())
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestDigger_HttpKeepAlive(t *testing.T) {
+	var upstreamConns int32
+	plain := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	plain.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&upstreamConns, 1)
+		}
+	}
+	plain.Start()
+	defer plain.Close()
+
+	d, stop := startTestDigger(t)
+	defer stop()
+
+	var clientConns int32
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&clientConns, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	get := func(p string, close bool) {
+		req, _ := http.NewRequest(http.MethodGet, plain.URL+p, nil)
+		req.Close = close
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %s", p, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != p {
+			t.Errorf("get %s got %q", p, body)
+		}
+	}
+
+	for _, p := range []string{"/a", "/b", "/c"} {
+		get(p, false)
+	}
+	if c, u := atomic.LoadInt32(&clientConns), atomic.LoadInt32(&upstreamConns); c != 1 || u != 1 {
+		t.Errorf("keep-alive: expect 1 client and 1 upstream conn, got %d and %d", c, u)
+	}
+	// Connection: close ends both conns, the next request needs new ones
+	get("/close", true)
+	get("/d", false)
+	if c, u := atomic.LoadInt32(&clientConns), atomic.LoadInt32(&upstreamConns); c != 2 || u != 2 {
+		t.Errorf("close: expect 2 client and 2 upstream conns, got %d and %d", c, u)
+	}
+	history := d.History()
+	if len(history) != 5 || !history[1].Timing.Reused || history[4].Timing.Reused {
+		t.Errorf("unexpected reuse in history of %d records", len(history))
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// FaultStatus answers with Status, Header and Body instead of asking upstream.
+	FaultStatus = "status"
+	// FaultDelay waits DelayMs before forwarding.
+	FaultDelay = "delay"
+	// FaultHang holds the request until the client gives up, at most DelayMs.
+	FaultHang = "hang"
+	// FaultReset drops the connection after AfterBytes of the response body.
+	FaultReset = "reset"
+	// FaultTruncate ends the response body after AfterBytes, keeping the original length.
+	FaultTruncate = "truncate"
+	// FaultCorrupt flips random bytes of the response body.
+	FaultCorrupt = "corrupt"
+
+	defaultFaultHang = 10 * time.Minute
+)
+
+// errFaultReset is returned by the body of a FaultReset response,
+// handlers drop the client connection when they see it.
+var errFaultReset = errors.New("connection reset by fault injection")
+
+// FaultRule injects a fault into matching requests.
+type FaultRule struct {
+	// Hosts are hostPatterns and Paths are path.Match patterns, empty matches all.
+	Hosts []string
+	Paths []string
+	// Probability of applying the fault in (0, 1], 0 means always.
+	Probability float64
+	Action      string
+
+	Status  int
+	Header  map[string]string
+	Body    string
+	DelayMs int
+	// AfterBytes is where reset and truncate cut the body, default is half of it.
+	AfterBytes int64
+}
+
+type faults struct {
+	mtx   sync.Mutex
+	rules []FaultRule
+	// clients are the rules each client set when Clients.Scoped, tried before the shared rules
+	clients map[string][]FaultRule
+}
+
+func (f *faults) init(rules []FaultRule) {
+	f.set("", rules)
+}
+
+// set replaces the rules of client, the shared ones for "".
+func (f *faults) set(client string, rules []FaultRule) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if client == "" {
+		f.rules = rules
+		return
+	}
+	if f.clients == nil {
+		f.clients = map[string][]FaultRule{}
+	}
+	if len(rules) == 0 {
+		delete(f.clients, client)
+		return
+	}
+	f.clients[client] = rules
+}
+
+func (f *faults) get(client string) []FaultRule {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if client == "" {
+		return f.rules
+	}
+	return f.clients[client]
+}
+
+// pick returns the fault to inject into req sent by client, nil for none.
+func (f *faults) pick(req *http.Request, client string) *FaultRule {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, rules := range [][]FaultRule{f.clients[client], f.rules} {
+		for i := range rules {
+			rule := rules[i]
+			if !rule.match(req) {
+				continue
+			}
+			if rule.Probability > 0 && rand.Float64() >= rule.Probability {
+				continue
+			}
+			return &rule
+		}
+	}
+	return nil
+}
+
+func (r *FaultRule) match(req *http.Request) bool {
+	if len(r.Hosts) > 0 && !hostPatterns(r.Hosts).Match(req.Host) {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	for _, p := range r.Paths {
+		if ok, err := path.Match(p, req.URL.Path); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String is what the record keeps to tell which fault was injected.
+func (r *FaultRule) String() string {
+	switch r.Action {
+	case FaultStatus:
+		return FaultStatus + ":" + strconv.Itoa(r.status())
+	case FaultDelay:
+		return FaultDelay + ":" + strconv.Itoa(r.DelayMs) + "ms"
+	case FaultReset, FaultTruncate:
+		if r.AfterBytes > 0 {
+			return r.Action + ":" + strconv.FormatInt(r.AfterBytes, 10)
+		}
+	}
+	return r.Action
+}
+
+func (r *FaultRule) status() int {
+	if r.Status == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return r.Status
+}
+
+// beforeUpstream applies the request side of the fault,
+// returning the response to answer with if upstream must not be asked.
+func (r *FaultRule) beforeUpstream(req *http.Request) *http.Response {
+	switch r.Action {
+	case FaultStatus:
+		header := http.Header{}
+		for k, v := range r.Header {
+			header.Set(k, v)
+		}
+		return newResponse(req, r.status(), header, []byte(r.Body))
+	case FaultDelay:
+		time.Sleep(time.Duration(r.DelayMs) * time.Millisecond)
+	case FaultHang:
+		max := defaultFaultHang
+		if r.DelayMs > 0 {
+			max = time.Duration(r.DelayMs) * time.Millisecond
+		}
+		t := time.NewTimer(max)
+		defer t.Stop()
+		gone, stop := clientGone(req)
+		defer stop()
+		select {
+		case <-req.Context().Done():
+		case <-gone:
+		case <-t.C:
+		}
+		return newTextResponse(req, http.StatusGatewayTimeout, "digger: request hung by fault injection\n")
+	}
+	return nil
+}
+
+// wrapResponse applies the response side of the fault to resp's body.
+func (r *FaultRule) wrapResponse(resp *http.Response) {
+	after := r.AfterBytes
+	if after <= 0 {
+		after = 1024
+		if resp.ContentLength > 0 {
+			after = resp.ContentLength / 2
+		}
+	}
+	switch r.Action {
+	case FaultReset:
+		resp.Body = &faultBody{ReadCloser: resp.Body, remain: after, err: errFaultReset}
+	case FaultTruncate:
+		resp.Body = &faultBody{ReadCloser: resp.Body, remain: after, err: io.EOF}
+	case FaultCorrupt:
+		resp.Body = &faultBody{ReadCloser: resp.Body, remain: -1, corrupt: true}
+	}
+}
+
+// cutsBody tells if the client gets less than upstream sent,
+// the connection can not be reused afterwards.
+func (r *FaultRule) cutsBody() bool {
+	return r.Action == FaultReset || r.Action == FaultTruncate
+}
+
+// faultBody ends with err after remain bytes, remain < 0 never ends early.
+type faultBody struct {
+	io.ReadCloser
+	remain  int64
+	err     error
+	corrupt bool
+}
+
+func (b *faultBody) Read(p []byte) (int, error) {
+	if b.remain == 0 {
+		return 0, b.err
+	}
+	if b.remain > 0 && int64(len(p)) > b.remain {
+		p = p[:b.remain]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.remain > 0 {
+		b.remain -= int64(n)
+	}
+	if b.corrupt {
+		for i := 0; i < n; i++ {
+			// about one byte in a hundred
+			if rand.Intn(100) == 0 {
+				p[i] ^= byte(1 + rand.Intn(255))
+			}
+		}
+	}
+	return n, err
+}
+
+// BuildHandler shows the fault rules on GET and replaces them on POST with a JSON list.
+func (f *faults) BuildHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		client := scope(req)
+		if req.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				log.Error("read faults body fail: %s", err.Error())
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var rules []FaultRule
+			if err = json.Unmarshal(body, &rules); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			for i, rule := range rules {
+				if err = rule.validate(); err != nil {
+					writer.WriteHeader(http.StatusBadRequest)
+					_, _ = writer.Write([]byte(fmt.Sprintf("rule %d: %s", i, err.Error())))
+					return
+				}
+			}
+			f.set(client, rules)
+			log.Info("fault rules of %q updated: %d rules", client, len(rules))
+		}
+		j, _ := json.Marshal(f.get(client))
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("faults write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+func (r *FaultRule) validate() error {
+	switch r.Action {
+	case FaultStatus, FaultDelay, FaultHang, FaultReset, FaultTruncate, FaultCorrupt:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("probability %v out of range", r.Probability)
+	}
+	return nil
+}
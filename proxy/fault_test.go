@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/er1c-zh/digger/util"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFaultRule_Match(t *testing.T) {
+	rule := FaultRule{Hosts: []string{"*.example.com"}, Paths: []string{"/api/*"}}
+	for u, expect := range map[string]bool{
+		"http://www.example.com/api/user":   true,
+		"http://www.example.com/api/a/b":    false,
+		"http://www.example.com/static/a":   false,
+		"http://example.com/api/user":       false,
+		"https://www.example.com:443/api/x": true,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		if rule.match(req) != expect {
+			t.Errorf("match(%s) expect %v", u, expect)
+		}
+	}
+}
+
+func TestFaultRule_WrapResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 100)
+	for action, expect := range map[string]int{
+		FaultTruncate: 10,
+		FaultReset:    10,
+		FaultCorrupt:  100,
+	} {
+		rule := FaultRule{Action: action, AfterBytes: 10}
+		resp := &http.Response{ContentLength: 100, Body: ioutil.NopCloser(bytes.NewReader(body))}
+		rule.wrapResponse(resp)
+		got, err := ioutil.ReadAll(resp.Body)
+		if len(got) != expect {
+			t.Errorf("%s: read %d bytes, expect %d", action, len(got), expect)
+		}
+		if (action == FaultReset) != (err == errFaultReset) {
+			t.Errorf("%s: unexpected err %v", action, err)
+		}
+	}
+}
+
+func TestDigger_HttpsFaultHang(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer secure.Close()
+	d, stop := startTestDigger(t, WithUpstreamVerify(UpstreamVerifySkip), func(d *Digger) {
+		d.Faults = []FaultRule{{Paths: []string{"/hang/*"}, Action: FaultHang, DelayMs: 10000}}
+	})
+	defer stop()
+
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(util.CA.Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	// set the tunnel up first, so the client gives up while the request hangs
+	resp, err := client.Get(secure.URL + "/warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	// the client gives up and closes the tunnel, the hang ends with it
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, secure.URL+"/hang/gone", nil)
+	if _, err := client.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("expect the request to hang")
+	}
+	for i := 0; i < 100 && len(d.History()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if history := d.History(); len(history) != 2 || history[1].Fault != FaultHang {
+		t.Fatalf("expect the hang to end once the client left, got %+v", history)
+	}
+
+	// shutting down ends the hang too
+	status := make(chan int, 1)
+	go func() {
+		resp, err := client.Get(secure.URL + "/hang/shutdown")
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expect shutdown to end the hang, took %s", took)
+	}
+	if got := <-status; got != http.StatusGatewayTimeout {
+		t.Errorf("expect 504 for the hung request, got %d", got)
+	}
+}
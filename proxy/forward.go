@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ForwardHeaders are the headers digger adds to what it forwards, all are off by default
+// so servers see the traffic as if there was no proxy.
+type ForwardHeaders struct {
+	// Via is the pseudonym in Via headers of requests and responses, e.g. "digger", empty adds none.
+	Via string
+	// Forwarded adds an RFC 7239 element with the client address, host and protocol.
+	Forwarded bool
+	// XForwardedFor appends the client address to X-Forwarded-For.
+	XForwardedFor bool
+}
+
+// hopHeaders describe a single connection and are never forwarded, see RFC 9110 section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hopHeaders and the headers listed in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		out[k] = append([]string(nil), vs...)
+	}
+	return out
+}
+
+// prepareRequest turns req into what is sent upstream and records it as UpstreamReq.
+func (d *Digger) prepareRequest(req *http.Request, record *Record) {
+	removeHopHeaders(req.Header)
+	if name := d.Clients.header(); name != "" {
+		req.Header.Del(name)
+	}
+	if n, ok := maxForwards(req); ok && n > 0 {
+		req.Header.Set("Max-Forwards", strconv.Itoa(n-1))
+	}
+	proto := "http"
+	if record.IsHttps {
+		proto = "https"
+	}
+	d.Forward.addTo(req, proto)
+	record.UpstreamReq = recordUpstreamReq(req)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// an empty value keeps req.Write from sending Go's own
+		req.Header["User-Agent"] = []string{""}
+	}
+}
+
+// prepareUpstreamResponse removes what only described the upstream conn.
+func (d *Digger) prepareUpstreamResponse(resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	if d.Forward.Via != "" {
+		resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, d.Forward.Via))
+	}
+}
+
+func (f *ForwardHeaders) addTo(req *http.Request, proto string) {
+	if f.Via != "" {
+		req.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, f.Via))
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if f.Forwarded {
+		req.Header.Add("Forwarded", "for="+forwardedNode(ip)+";host="+forwardedValue(req.Host)+";proto="+proto)
+	}
+	if f.XForwardedFor {
+		if prior, ok := req.Header["X-Forwarded-For"]; ok {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+}
+
+// forwardedNode formats ip as a Forwarded node, IPv6 goes in quoted brackets.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes v unless it is a token.
+func forwardedValue(v string) string {
+	if strings.ContainsAny(v, ":[]\" ") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// maxForwards returns the Max-Forwards of a TRACE or OPTIONS request, ok is false without one.
+func maxForwards(req *http.Request) (int, bool) {
+	if req.Method != http.MethodTrace && req.Method != http.MethodOptions {
+		return 0, false
+	}
+	v := req.Header.Get("Max-Forwards")
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// traceExclude are kept out of a TRACE echo, they may carry credentials.
+var traceExclude = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// answerMaxForwards answers a TRACE or OPTIONS request that may not be forwarded any further.
+func answerMaxForwards(req *http.Request) *http.Response {
+	if n, ok := maxForwards(req); !ok || n != 0 {
+		return nil
+	}
+	header := http.Header{}
+	if req.Method == http.MethodOptions {
+		header.Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, CONNECT, OPTIONS, TRACE")
+		return newResponse(req, http.StatusOK, header, nil)
+	}
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "%s %s %s\r\nHost: %s\r\n", req.Method, req.RequestURI, req.Proto, req.Host)
+	_ = req.Header.WriteSubset(&b, traceExclude)
+	b.WriteString("\r\n")
+	header.Set("Content-Type", "message/http")
+	return newResponse(req, http.StatusOK, header, b.Bytes())
+}
+
+// expectContinueTimeout is how long upstream may take to answer Expect: 100-continue
+// before the body is sent anyway, the same as http.DefaultTransport.
+const expectContinueTimeout = time.Second
+
+// errExpectRejected ends a request whose body was held back because of a final response.
+var errExpectRejected = errors.New("final response to Expect: 100-continue, body not sent")
+
+func expectsContinue(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && req.ContentLength != 0 && req.Body != nil && req.Body != http.NoBody &&
+		strings.EqualFold(strings.TrimSpace(req.Header.Get("Expect")), "100-continue")
+}
+
+// continueBody holds back the body of a request expecting 100-continue until upstream
+// agrees. The client's body is not read before that, so the client only gets its
+// 100 Continue after upstream did.
+type continueBody struct {
+	io.ReadCloser
+	u      *upstream
+	req    *http.Request
+	waited bool
+	// final is what upstream answered instead of 100 Continue
+	final *http.Response
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	if !b.waited {
+		b.waited = true
+		if b.final = b.wait(); b.final != nil {
+			return 0, errExpectRejected
+		}
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// wait returns the final response upstream sent to the request head, nil if the body
+// is to be sent: upstream agreed, did not answer in time or failed in a way
+// reading the response will report.
+func (b *continueBody) wait() *http.Response {
+	_ = b.u.conn.SetReadDeadline(time.Now().Add(expectContinueTimeout))
+	_, err := b.u.r.Peek(1)
+	_ = b.u.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil
+	}
+	for {
+		resp, err := http.ReadResponse(b.u.r, b.req)
+		if err != nil || resp.StatusCode == http.StatusContinue {
+			return nil
+		}
+		if isInformational(resp.StatusCode) {
+			continue
+		}
+		// upstream may still wait for the body, the conn can't be reused
+		resp.Close = true
+		return resp
+	}
+}
+
+// isInformational tells 1xx responses that are followed by another one, 101 ends the exchange.
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// continueReader sends 100 Continue to a MITM client the first time its body is read,
+// as net/http's server does for plain HTTP.
+type continueReader struct {
+	io.ReadCloser
+	w    io.Writer
+	sent bool
+}
+
+func (r *continueReader) Read(p []byte) (int, error) {
+	if !r.sent {
+		r.sent = true
+		if _, err := io.WriteString(r.w, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	return r.ReadCloser.Read(p)
+}
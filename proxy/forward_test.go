@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Secret")
+	h.Set("Proxy-Connection", "keep-alive")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Te", "trailers")
+	h.Set("Upgrade", "websocket")
+	h.Set("Proxy-Authorization", "Basic eDp5")
+	h.Set("X-Secret", "1")
+	h.Set("Accept", "*/*")
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("Accept") != "*/*" {
+		t.Errorf("unexpected headers left: %v", h)
+	}
+}
+
+func TestDigger_PrepareRequest(t *testing.T) {
+	d := &Digger{Forward: ForwardHeaders{Via: "digger", Forwarded: true, XForwardedFor: true}}
+	req := httptest.NewRequest(http.MethodOptions, "http://example.com:8080/", nil)
+	req.RemoteAddr = "[::1]:5000"
+	req.Header.Set("Max-Forwards", "3")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	record := &Record{Req: &RecordReq{}}
+	d.prepareRequest(req, record)
+
+	for name, expect := range map[string]string{
+		"Via":             "1.1 digger",
+		"Forwarded":       `for="[::1]";host="example.com:8080";proto=http`,
+		"X-Forwarded-For": "10.0.0.1, ::1",
+		"Max-Forwards":    "2",
+	} {
+		if got := record.UpstreamReq.Header.Get(name); got != expect {
+			t.Errorf("%s got %q, expect %q", name, got, expect)
+		}
+	}
+	if _, ok := record.UpstreamReq.Header["User-Agent"]; ok {
+		t.Errorf("User-Agent should not be added to the record")
+	}
+}
+
+func TestAnswerMaxForwards(t *testing.T) {
+	req := httptest.NewRequest(http.MethodTrace, "http://example.com/t", nil)
+	req.Header.Set("Max-Forwards", "0")
+	req.Header.Set("Cookie", "secret")
+	req.Header.Set("X-Seen", "1")
+	resp := answerMaxForwards(req)
+	if resp == nil {
+		t.Fatal("TRACE with Max-Forwards 0 should be answered")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(body), "TRACE http://example.com/t HTTP/1.1\r\n") ||
+		!strings.Contains(string(body), "X-Seen: 1") || strings.Contains(string(body), "secret") {
+		t.Errorf("unexpected TRACE echo %q", body)
+	}
+
+	req.Header.Set("Max-Forwards", "1")
+	if answerMaxForwards(req) != nil {
+		t.Errorf("TRACE with Max-Forwards 1 should be forwarded")
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Max-Forwards", "0")
+	if answerMaxForwards(req) != nil {
+		t.Errorf("Max-Forwards only applies to TRACE and OPTIONS")
+	}
+}
+
+func TestDigger_ExpectContinue(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer plain.Close()
+	d, stop := startTestDigger(t)
+	defer stop()
+
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		// a proxy not passing 100 Continue on makes the client wait this long
+		ExpectContinueTimeout: 5 * time.Second,
+	}}
+	for p, expect := range map[string]string{
+		"/accept": "200 payload",
+		"/reject": "417 ",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, plain.URL+p, strings.NewReader("payload"))
+		req.Header.Set("Expect", "100-continue")
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post %s: %s", p, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if got := resp.Status[:3] + " " + string(body); got != expect {
+			t.Errorf("post %s got %q, expect %q", p, got, expect)
+		}
+		if elapsed := time.Since(start); elapsed > expectContinueTimeout/2 {
+			t.Errorf("post %s took %s, 100 Continue was not passed on", p, elapsed)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/er1c-zh/go-now/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harBody struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 if the phase does not apply.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func (l *_recordList) BuildHarHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		records := l.snapshotOf(scope(req))
+
+		har := harLog{Log: harContent{
+			Version: "1.2",
+			Creator: harCreator{Name: "digger", Version: "0.1"},
+			Entries: make([]harEntry, 0, len(records)),
+		}}
+		for _, record := range records {
+			if record.Req == nil || record.Tunnel != nil {
+				continue
+			}
+			har.Log.Entries = append(har.Log.Entries, newHarEntry(record))
+		}
+		j, err := json.Marshal(har)
+		if err != nil {
+			log.Error("marshal har fail: %s", err.Error())
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.Header().Set("content-disposition", "attachment; filename=\"digger.har\"")
+		writer.WriteHeader(http.StatusOK)
+		_, err = writer.Write(j)
+		if err != nil {
+			log.Error("har write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+func newHarEntry(record Record) harEntry {
+	req := record.Req
+	entry := harEntry{
+		StartedDateTime: record.TimeStart.Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         record.URL(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(req.BodyOrigin),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Comment: record.Error,
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	for _, c := range (&http.Request{Header: req.Header}).Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	if len(req.BodyOrigin) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     string(req.BodyOrigin),
+		}
+	}
+	if resp := record.Resp; resp != nil {
+		entry.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(resp.Header),
+			Content: harBody{
+				Size:     len(resp.BodyOrigin),
+				MimeType: resp.Header.Get("Content-Type"),
+				Text:     string(resp.BodyOrigin),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(resp.BodyOrigin),
+		}
+		for _, c := range resp.Cookies {
+			entry.Response.Cookies = append(entry.Response.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+		}
+	}
+
+	t := record.Timing
+	entry.Timings = harTimings{
+		Blocked: harMillis(t.phase(phaseBlocked)),
+		DNS:     harMillis(t.phase(phaseDNS)),
+		Connect: harMillis(t.phase(phaseConnect)),
+		Send:    harMillis(t.phase(phaseSend)),
+		Wait:    harMillis(t.phase(phaseWait)),
+		Receive: harMillis(t.phase(phaseReceive)),
+		SSL:     harMillis(t.phase(phaseTLS)),
+	}
+	// send, wait and receive are required to be non-negative
+	for _, v := range []*float64{&entry.Timings.Send, &entry.Timings.Wait, &entry.Timings.Receive} {
+		if *v < 0 {
+			*v = 0
+		}
+	}
+	// HAR counts ssl as part of connect
+	if entry.Timings.Connect >= 0 && entry.Timings.SSL > 0 {
+		entry.Timings.Connect += entry.Timings.SSL
+	}
+	if !record.TimeRespFinish.IsZero() {
+		entry.Time = harMillis(record.TimeRespFinish.Sub(record.TimeStart))
+	}
+	if record.TLS != nil {
+		entry.Connection = "tls-" + strconv.FormatInt(record.TLS.ID, 10)
+	}
+	return entry
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	list := make([]harNameValue, 0, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			list = append(list, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func harMillis(d time.Duration) float64 {
+	if d < 0 {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import "net/http"
+
+// Hook observes and changes the traffic through a Digger,
+// embed BaseHook to implement only some of the methods.
+// Hooks run on the goroutine of the request, keep them quick.
+type Hook interface {
+	// OnRequest sees a request before it is forwarded and may change it.
+	// A non-nil response answers the request without asking upstream.
+	OnRequest(req *http.Request) *http.Response
+	// OnResponse may change resp before it is written to the client, resp.Request is the request.
+	OnResponse(resp *http.Response)
+	// OnRecord gets every finished exchange.
+	OnRecord(r Record)
+}
+
+// BaseHook does nothing.
+type BaseHook struct{}
+
+func (BaseHook) OnRequest(*http.Request) *http.Response { return nil }
+func (BaseHook) OnResponse(*http.Response)              {}
+func (BaseHook) OnRecord(Record)                        {}
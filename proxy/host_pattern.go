@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"path"
+	"strings"
+)
+
+// hostPatterns matches hosts against shell patterns such as "*.example.com".
+// "*" never crosses a ".", so "*.example.com" does not match "example.com" itself;
+// list both to cover a domain and its sub-domains.
+type hostPatterns []string
+
+func (p hostPatterns) Match(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	for _, pattern := range p {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == host {
+		return true
+	}
+	// path.Match stops "*" at "/", swap dots in so it stops at labels instead.
+	ok, err := path.Match(strings.Replace(pattern, ".", "/", -1), strings.Replace(host, ".", "/", -1))
+	return err == nil && ok
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import "testing"
+
+func TestHostPatterns_Match(t *testing.T) {
+	p := hostPatterns{"example.com", "*.bank.com", "api-?.test.io"}
+	for host, expect := range map[string]bool{
+		"example.com":         true,
+		"EXAMPLE.com:443":     true,
+		"www.example.com":     false,
+		"www.bank.com":        true,
+		"bank.com":            false,
+		"a.b.bank.com":        false,
+		"api-1.test.io":       true,
+		"api-10.test.io":      false,
+		"unrelated.org":       false,
+		"www.bank.com.evil.o": false,
+	} {
+		if p.Match(host) != expect {
+			t.Errorf("Match(%s) expect %v", host, expect)
+		}
+	}
+}
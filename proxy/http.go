@@ -1,11 +1,8 @@
 package proxy
 
 import (
-	"bufio"
-	"bytes"
 	"github.com/er1c-zh/go-now/log"
 	"io"
-	"net"
 	"net/http"
 	"time"
 )
@@ -17,7 +14,9 @@ func (d *Digger) BuildHttpHandler() func(http.ResponseWriter, *http.Request) {
 			log.Error("wrapRequest fail: %s", err.Error())
 			return
 		}
-		record := _record{
+		record := Record{
+			Client:         d.clientOf(req, proxyUserOf(req)),
+			User:           proxyUserOf(req),
 			Req:            reqRecord,
 			Resp:           nil,
 			TimeStart:      time.Now(),
@@ -25,46 +24,29 @@ func (d *Digger) BuildHttpHandler() func(http.ResponseWriter, *http.Request) {
 			TimeRespFinish: time.Time{},
 		}
 		defer func() {
-			// req never nil
-			_req, err := http.NewRequest(record.Req.Method, record.Req.URL.String(), bytes.NewReader(record.Req.BodyOrigin))
-			if err != nil {
-				log.Error("NewRequest fail: %s", err.Error())
-			}
-			err = _req.ParseForm()
-			if err != nil {
-				log.Error("ParseForm fail: %s", err.Error())
-			}
-			if record.Resp != nil {
-				record.Resp.Body = string(record.Resp.BodyOrigin)
-			}
-			record.Req.Form = _req.Form
-			d.history.Add(record)
+			d.addRecord(record)
 		}()
 
-		addr := req.URL.Host
-		if req.URL.Port() == "" {
-			addr += ":80"
-		}
-		// todo use net pool
-		conn, err := net.Dial("tcp", addr)
-		if err != nil {
-			log.Error("dial (%s) fail: %s", addr, err.Error())
-			return
-		}
+		// the upstream conn goes back to the pool only if the response was read to its end.
+		// a client sending Connection: close or speaking HTTP/1.0 has req.Close set,
+		// req.Write passes it upstream and the response then has Close set too.
+		u := &upstream{action: ConnAction{URL: req.URL, Throttle: d.throttleUpstream(req)}}
+		broken := true
 		defer func() {
-			_ = conn.Close()
+			u.release(broken)
 		}()
-		err = req.Write(conn)
-		if err != nil {
-			log.Error("write fail: %s", err.Error())
-			return
-		}
-		record.TimeReqFinish = time.Now()
-		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
-		if err != nil {
-			log.Error("ReadResponse fail: %s", err.Error())
-			return
+
+		resp := d.localResponse(req, &record)
+		if resp == nil {
+			resp, err = d.roundTrip(u, req, &record)
+			if err != nil {
+				log.Error("round trip to %s fail: %s", req.URL.Host, err.Error())
+				record.Error = err.Error()
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
 		}
+		d.prepareResponse(resp, &record)
 		record.Resp, err = recordRespFromHttpResp(resp)
 		defer func() {
 			_ = resp.Body.Close()
@@ -79,12 +61,21 @@ func (d *Digger) BuildHttpHandler() func(http.ResponseWriter, *http.Request) {
 			}
 		}
 		w.WriteHeader(resp.StatusCode)
-		n, err := io.Copy(w, resp.Body)
+		_, err = io.Copy(w, resp.Body)
+		record.TimeRespFinish = time.Now()
 		if err != nil {
 			log.Error("io.Copy fail: %s", err.Error())
+			if err == errFaultReset {
+				record.Error = err.Error()
+				// let the partial body out before dropping the connection
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				panic(http.ErrAbortHandler)
+			}
 			return
 		}
-		log.Info("io.Copy cnt: %d", n)
+		broken = resp.Close || (record.fault != nil && record.fault.cutsBody())
 		return
 	}
 }
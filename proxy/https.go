@@ -2,11 +2,13 @@ package proxy
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
 	"github.com/er1c-zh/digger/util"
 	"github.com/er1c-zh/go-now/log"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"time"
 )
@@ -20,7 +22,7 @@ func (d *Digger) BuildHttpsHandler() func(http.ResponseWriter, *http.Request) {
 			log.Warn("c8n can't be hijacked")
 			return
 		}
-		connToClient, _, err := wHiJack.Hijack()
+		connToClient, rw, err := wHiJack.Hijack()
 		if err != nil {
 			log.Error("hijack fail: %s", err.Error())
 			return
@@ -28,24 +30,51 @@ func (d *Digger) BuildHttpsHandler() func(http.ResponseWriter, *http.Request) {
 		defer func() {
 			_ = connToClient.Close()
 		}()
+		if !d.hijacked.add(connToClient) {
+			return
+		}
+		defer d.hijacked.remove(connToClient)
 		_, err = connToClient.Write([]byte("HTTP/1.1 200 Connection established!\r\n\r\n"))
 		if err != nil {
 			log.Error("write response to client fail: %s", err.Error())
 			return
 		}
 
-		// todo cache certificate
-		cert, err := util.SignHost([]string{stripPort(__req.Host)})
+		if d.shouldPassthrough(__req.Host) {
+			// a tunnel is never between exchanges, so it counts as idle and shutdown closes it
+			if !d.hijacked.idle(connToClient) {
+				return
+			}
+			d.tunnel(connToClient, rw.Reader, __req)
+			return
+		}
+
+		certStart := time.Now()
+		cert, hit, err := d.certCache.Get(stripPort(__req.Host))
 		if err != nil {
 			log.Error("gen cert fail: %s", err.Error())
 			return
 		}
+		if hit {
+			d.AddCertCacheHit()
+		} else {
+			d.AddCertCacheMiss()
+			d.metrics.observeCertGen(time.Since(certStart))
+		}
 
-		tlsToClient := tls.Server(connToClient, &tls.Config{
+		tlsConfig := &tls.Config{
 			Certificates:       []tls.Certificate{*cert},
+			NextProtos:         alpnProtos,
 			InsecureSkipVerify: true,
-		})
-		if err := tlsToClient.Handshake(); err != nil {
+			KeyLogWriter:       &d.keyLog,
+		}
+		// share ticket keys between connections so clients can resume
+		tlsConfig.SetSessionTicketKeys(d.ticketKeys)
+		tlsToClient := tls.Server(&bufferedConn{Conn: connToClient, r: rw.Reader}, tlsConfig)
+		err = tlsToClient.Handshake()
+		d.recordHandshakeResult(__req.Host, err)
+		if err != nil {
+			d.metrics.addClientTLSFailure()
 			log.Error("shake hand with client fail: %s", err.Error())
 			return
 		}
@@ -53,20 +82,24 @@ func (d *Digger) BuildHttpsHandler() func(http.ResponseWriter, *http.Request) {
 			_ = tlsToClient.Close()
 		}()
 		tlsToClientReader := bufio.NewReader(tlsToClient)
+		session := newTLSSession(tlsToClient)
+		ctx, cancel := d.tunnelContext(tlsToClient, tlsToClientReader)
+		defer cancel()
 
-		conn2Server, err := DefaultConnPool.GetOrCreate(ConnAction{
-			URL: util.CopyAndFillURL(__req.URL, true),
-			//ForceNew: true,
-		})
-		if err != nil {
-			log.Error("GetOrCreate fail: %s", err.Error())
-			return
-		}
-		defer DefaultConnPool.Put(conn2Server)
-		serReader := bufio.NewReader(conn2Server)
+		// requests not answered locally take a conn from the pool for their exchange
+		u := &upstream{action: ConnAction{
+			URL:       util.CopyAndFillURL(__req.URL, true),
+			TLSConfig: d.upstreamTLSConfig(stripPort(__req.Host)),
+			Throttle:  d.throttleUpstream(__req),
+		}}
+		defer u.release(false)
 		var innerErr error
 		for innerErr == nil {
 			func() {
+				if !d.hijacked.idle(connToClient) {
+					innerErr = http.ErrServerClosed
+					return
+				}
 				_req, err := http.ReadRequest(tlsToClientReader)
 				if err != nil {
 					if err != io.EOF {
@@ -75,48 +108,48 @@ func (d *Digger) BuildHttpsHandler() func(http.ResponseWriter, *http.Request) {
 					innerErr = err
 					return
 				}
+				d.hijacked.busy(connToClient)
+				_req = _req.WithContext(ctx)
+				_req.RemoteAddr = connToClient.RemoteAddr().String()
+				var expect *continueReader
+				if expectsContinue(_req) {
+					expect = &continueReader{ReadCloser: _req.Body, w: tlsToClient}
+					_req.Body = expect
+				}
 				req, reqRecord, err := wrapRequest(_req)
 				if err != nil {
 					log.Error("wrapRequest fail: %s", err.Error())
 					innerErr = err
 					return
 				}
-				record := _record{
+				record := Record{
+					Client:         d.clientOf(req, proxyUserOf(__req)),
+					User:           proxyUserOf(__req),
 					Req:            reqRecord,
 					Resp:           nil,
 					TimeStart:      time.Now(),
 					TimeReqFinish:  time.Time{},
 					TimeRespFinish: time.Time{},
 					IsHttps:        true,
+					TLS:            session,
 				}
 				defer func() {
-					// req never nil
-					_req, err := http.NewRequest(record.Req.Method, record.Req.URL.String(), bytes.NewReader(record.Req.BodyOrigin))
-					if err != nil {
-						log.Error("NewRequest fail: %s", err.Error())
-					}
-					err = _req.ParseForm()
+					d.addRecord(record)
+				}()
+				resp := d.localResponse(req, &record)
+				if resp == nil {
+					resp, err = d.roundTrip(u, req, &record)
 					if err != nil {
-						log.Error("ParseForm fail: %s", err.Error())
-					}
-					if record.Resp != nil {
-						record.Resp.Body = string(record.Resp.BodyOrigin)
+						log.Error("round trip to %s fail: %s", req.Host, err.Error())
+						innerErr = err
+						record.Error = err.Error()
+						// a failed dial or verification shows up at the client too
+						resp = upstreamFailResponse(req, err)
+					} else {
+						record.TLS = session.via(u.conn)
 					}
-					record.Req.Form = _req.Form
-					d.history.Add(record)
-				}()
-				err = req.Write(conn2Server)
-				if err != nil {
-					log.Error("req.Write fail: %s", err.Error())
-					innerErr = err
-					return
-				}
-				resp, err := http.ReadResponse(serReader, req)
-				if err != nil {
-					log.Error("ReadResponse fail: %s", err.Error())
-					innerErr = err
-					return
 				}
+				d.prepareResponse(resp, &record)
 				record.Resp, err = recordRespFromHttpResp(resp)
 				defer func() {
 					_ = resp.Body.Close()
@@ -124,17 +157,94 @@ func (d *Digger) BuildHttpsHandler() func(http.ResponseWriter, *http.Request) {
 				if err != nil {
 					log.Error("ReadResponse fail: %s", err.Error())
 					innerErr = err
+					record.Error = err.Error()
 					return
 				}
 
+				if expect != nil && !expect.sent {
+					// the client still holds its body back, what it sends next is unknown
+					resp.Close = true
+					innerErr = errExpectRejected
+				}
 				err = resp.Write(tlsToClient)
+				record.TimeRespFinish = time.Now()
 				if err != nil {
 					log.Error("write to tlsToClient fail: %s", err.Error())
 					innerErr = err
+					if record.fault != nil {
+						record.Error = err.Error()
+					}
+					// the rest of upstream's body may still be unread
+					u.release(true)
 					return
 				}
+				if record.fault != nil && record.fault.cutsBody() {
+					innerErr = errFaultReset
+					u.release(true)
+					return
+				}
+				// the conn waits in the pool until the next request, an idle tunnel holds none
+				u.release(resp.Close)
 			}()
 		}
 		return
 	}
 }
+
+type clientWatchKey struct{}
+
+// tunnelContext is the context of the requests read from the tunnel, which http.Server does not serve.
+// It ends on shutdown, and clientGone can tell when the client of r leaves.
+func (d *Digger) tunnelContext(conn net.Conn, r *bufio.Reader) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-d.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	watch := func() (<-chan struct{}, func()) {
+		return watchClient(conn, r)
+	}
+	return context.WithValue(ctx, clientWatchKey{}, watch), cancel
+}
+
+// clientGone is closed when the client of req leaves while nothing reads from it,
+// stop must be called before reading from the client again.
+// The context of a plain request already ends then, http.Server watches its conn.
+func clientGone(req *http.Request) (gone <-chan struct{}, stop func()) {
+	watch, ok := req.Context().Value(clientWatchKey{}).(func() (<-chan struct{}, func()))
+	if !ok {
+		return nil, func() {}
+	}
+	return watch()
+}
+
+// watchClient peeks at r until the client closes, a deadline in the past stops it.
+// Bytes the client sends meanwhile, a pipelined request say, stay buffered and end the watch.
+func watchClient(conn net.Conn, r *bufio.Reader) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := r.Peek(1)
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			close(gone)
+		}
+	}()
+	return gone, func() {
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// upstreamFailResponse answers req with 502 when upstream could not be reached,
+// the tunnel is closed after it.
+func upstreamFailResponse(req *http.Request, err error) *http.Response {
+	_, _ = io.Copy(ioutil.Discard, req.Body)
+	resp := newTextResponse(req, http.StatusBadGateway, "digger: "+err.Error()+"\n")
+	resp.Close = true
+	return resp
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/er1c-zh/go-now/log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// keyLogWriter appends NSS key log lines of both TLS legs to a file,
+// so a pcap captured alongside can be decrypted by Wireshark.
+// It is attached to every tls.Config and only writes while enabled.
+type keyLogWriter struct {
+	mtx     sync.Mutex
+	path    string
+	enabled bool
+	f       *os.File
+}
+
+func (k *keyLogWriter) Write(p []byte) (int, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if !k.enabled {
+		return len(p), nil
+	}
+	if k.f == nil {
+		f, err := os.OpenFile(k.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Error("open key log file fail: %s", err.Error())
+			return 0, err
+		}
+		k.f = f
+	}
+	return k.f.Write(p)
+}
+
+func (k *keyLogWriter) SetEnabled(enabled bool) bool {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.path == "" {
+		return false
+	}
+	k.enabled = enabled
+	if !enabled && k.f != nil {
+		if err := k.f.Close(); err != nil {
+			log.Warn("close key log file fail: %s", err.Error())
+		}
+		k.f = nil
+	}
+	return true
+}
+
+func (k *keyLogWriter) BuildHandler() func(writer http.ResponseWriter, _ *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		k.writeStatus(writer, http.StatusOK)
+	}
+}
+
+func (k *keyLogWriter) BuildToggleHandler(enabled bool) func(writer http.ResponseWriter, _ *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		if !k.SetEnabled(enabled) {
+			k.writeStatus(writer, http.StatusBadRequest)
+			return
+		}
+		log.Info("key log enabled: %v", enabled)
+		k.writeStatus(writer, http.StatusOK)
+	}
+}
+
+func (k *keyLogWriter) writeStatus(writer http.ResponseWriter, statusCode int) {
+	k.mtx.Lock()
+	j, _ := json.Marshal(map[string]interface{}{
+		"Path":    k.path,
+		"Enabled": k.enabled,
+	})
+	k.mtx.Unlock()
+	writer.Header().Set("content-type", "application/json; charset=utf-8")
+	writer.WriteHeader(statusCode)
+	_, err := writer.Write(j)
+	if err != nil {
+		log.Error("key log write to writer fail: %s", err.Error())
+		return
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/er1c-zh/go-now/log"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MapLocalRule serves matching requests from Local instead of upstream.
+type MapLocalRule struct {
+	// Hosts are hostPatterns, empty matches all.
+	Hosts []string
+	// Path is a path.Match pattern when Local is a file. When Local is a directory
+	// it is a prefix, the rest of the request path is looked up under Local.
+	Path  string
+	Local string
+	// Header is added to the response, Content-Type is guessed from the extension otherwise.
+	Header map[string]string
+}
+
+type mapLocal struct {
+	mtx   sync.Mutex
+	rules []MapLocalRule
+	// clients are the rules each client set when Clients.Scoped, tried before the shared rules
+	clients map[string][]MapLocalRule
+}
+
+func (m *mapLocal) init(rules []MapLocalRule) {
+	m.set("", rules)
+}
+
+// set replaces the rules of client, the shared ones for "".
+func (m *mapLocal) set(client string, rules []MapLocalRule) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if client == "" {
+		m.rules = rules
+		return
+	}
+	if m.clients == nil {
+		m.clients = map[string][]MapLocalRule{}
+	}
+	if len(rules) == 0 {
+		delete(m.clients, client)
+		return
+	}
+	m.clients[client] = rules
+}
+
+func (m *mapLocal) get(client string) []MapLocalRule {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if client == "" {
+		return m.rules
+	}
+	return m.clients[client]
+}
+
+// lookup returns the local file for req sent by client and the rule it matched, "" if none matches.
+func (m *mapLocal) lookup(req *http.Request, client string) (string, *MapLocalRule) {
+	// the client's rules go first, copied so file does not stat under the lock
+	m.mtx.Lock()
+	rules := append(append([]MapLocalRule(nil), m.clients[client]...), m.rules...)
+	m.mtx.Unlock()
+	for i := range rules {
+		rule := &rules[i]
+		if len(rule.Hosts) > 0 && !hostPatterns(rule.Hosts).Match(req.Host) {
+			continue
+		}
+		if file := rule.file(req.URL.Path); file != "" {
+			return file, rule
+		}
+	}
+	return "", nil
+}
+
+func (r *MapLocalRule) file(urlPath string) string {
+	info, err := os.Stat(r.Local)
+	if err != nil {
+		log.Warn("map local %s fail: %s", r.Local, err.Error())
+		return ""
+	}
+	if !info.IsDir() {
+		if r.Path == "" {
+			return r.Local
+		}
+		if ok, err := path.Match(r.Path, urlPath); err == nil && ok {
+			return r.Local
+		}
+		return ""
+	}
+	prefix := strings.TrimSuffix(r.Path, "/")
+	if urlPath != prefix && !strings.HasPrefix(urlPath, prefix+"/") {
+		return ""
+	}
+	// Clean against "/" keeps the rest from climbing out of Local
+	rest := path.Clean("/" + strings.TrimPrefix(urlPath, prefix))
+	file := filepath.Join(r.Local, filepath.FromSlash(rest))
+	if info, err = os.Stat(file); err == nil && info.IsDir() {
+		file = filepath.Join(file, "index.html")
+	}
+	return file
+}
+
+// response reads file into a response, 404 if it is missing under a mapped directory.
+func (r *MapLocalRule) response(req *http.Request, file string) *http.Response {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newTextResponse(req, http.StatusNotFound, "digger: "+file+" not found\n")
+		}
+		log.Error("read local file fail: %s", err.Error())
+		return newTextResponse(req, http.StatusInternalServerError, "digger: "+err.Error()+"\n")
+	}
+	header := http.Header{}
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	header.Set("Content-Type", contentType)
+	for k, v := range r.Header {
+		header.Set(k, v)
+	}
+	return newResponse(req, http.StatusOK, header, body)
+}
+
+// BuildHandler shows the map local rules on GET and replaces them on POST with a JSON list.
+func (m *mapLocal) BuildHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		client := scope(req)
+		if req.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				log.Error("read map local body fail: %s", err.Error())
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var rules []MapLocalRule
+			if err = json.Unmarshal(body, &rules); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			m.set(client, rules)
+			log.Info("map local rules of %q updated: %d rules", client, len(rules))
+		}
+		j, _ := json.Marshal(m.get(client))
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("map local write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
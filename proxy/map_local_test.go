@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMapLocalRule_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maplocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	single := filepath.Join(dir, "user.json")
+	_ = ioutil.WriteFile(single, []byte("{}"), 0644)
+
+	dirRule := MapLocalRule{Path: "/static/", Local: dir}
+	fileRule := MapLocalRule{Path: "/api/*", Local: single}
+	for _, c := range []struct {
+		rule   MapLocalRule
+		path   string
+		expect string
+	}{
+		{dirRule, "/static/a.js", filepath.Join(dir, "a.js")},
+		{dirRule, "/static/sub", filepath.Join(dir, "sub", "index.html")},
+		{dirRule, "/static/../../etc/passwd", filepath.Join(dir, "etc", "passwd")},
+		{dirRule, "/staticx/a.js", ""},
+		{fileRule, "/api/user", single},
+		{fileRule, "/api/user/1", ""},
+	} {
+		if got := c.rule.file(c.path); got != c.expect {
+			t.Errorf("file(%s) = %s, expect %s", c.path, got, c.expect)
+		}
+	}
+}
+
+func TestDigger_MapLocalHttpsOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maplocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("local"), 0644)
+	// the host does not resolve, map local must answer without dialing it
+	d, stop := startTestDigger(t, func(d *Digger) {
+		d.MapLocal = []MapLocalRule{{Hosts: []string{"cdn.invalid"}, Path: "/static/", Local: dir}}
+	})
+	defer stop()
+
+	resp, err := newMITMClient(d).Get("https://cdn.invalid/static/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "local" {
+		t.Errorf("expect the local file, got %d %q", resp.StatusCode, body)
+	}
+	for i := 0; i < 100 && len(d.History()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if history := d.History(); len(history) != 1 || history[0].Local == "" || history[0].Error != "" {
+		t.Errorf("expect one local record without error, got %+v", history)
+	}
+}
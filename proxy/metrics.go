@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// latencyBuckets are the upper bounds in seconds of digger_request_duration_seconds.
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// certGenBuckets are the upper bounds in seconds of digger_cert_generation_seconds.
+	certGenBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+const (
+	// maxMetricHosts caps the host series, the hosts seen after are counted as otherMetricHost.
+	maxMetricHosts  = 200
+	otherMetricHost = "other"
+)
+
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type requestLabels struct {
+	host, method, status string
+}
+
+// metrics aggregate the finished records for /metrics and the summary log.
+type metrics struct {
+	mtx      sync.Mutex
+	requests map[requestLabels]int64
+	latency  map[string]*histogram
+	received map[string]int64
+	sent     map[string]int64
+	certGen  *histogram
+	// clientTLSFailures are failed handshakes with MITM clients,
+	// upstream ones are counted by the pool.
+	clientTLSFailures int64
+
+	// totals feed the summary log
+	total    summaryTotals
+	reported summaryTotals
+}
+
+type summaryTotals struct {
+	requests, errors, received, sent int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: map[requestLabels]int64{},
+		latency:  map[string]*histogram{},
+		received: map[string]int64{},
+		sent:     map[string]int64{},
+		certGen:  newHistogram(certGenBuckets),
+	}
+}
+
+// observe feeds a finished record to the metrics and the access log.
+func (d *Digger) observe(r *Record) {
+	d.metrics.observe(r)
+	d.accessLog.write(r)
+}
+
+// observe counts a finished record.
+func (m *metrics) observe(r *Record) {
+	if r.Req == nil {
+		return
+	}
+	host := strings.ToLower(stripPort(r.Req.Host))
+	status := "error"
+	var received, sent int64
+	switch {
+	case r.Tunnel != nil:
+		status = "tunnel"
+		received, sent = r.Tunnel.BytesClientToServer, r.Tunnel.BytesServerToClient
+	case r.Resp != nil:
+		status = strconv.Itoa(r.Resp.StatusCode)
+		received, sent = int64(len(r.Req.BodyOrigin)), int64(len(r.Resp.BodyOrigin))
+	default:
+		received = int64(len(r.Req.BodyOrigin))
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	host = m.hostLabel(host)
+	m.requests[requestLabels{host: host, method: r.Req.Method, status: status}]++
+	m.received[host] += received
+	m.sent[host] += sent
+	// a tunnel lasts as long as the client keeps it, that is no latency
+	if r.Tunnel == nil && !r.TimeRespFinish.IsZero() {
+		h, ok := m.latency[host]
+		if !ok {
+			h = newHistogram(latencyBuckets)
+			m.latency[host] = h
+		}
+		h.observe(r.TimeRespFinish.Sub(r.TimeStart).Seconds())
+	}
+	m.total.requests++
+	if r.failed() {
+		m.total.errors++
+	}
+	m.total.received += received
+	m.total.sent += sent
+}
+
+// hostLabel is the host label of host, every observed host is in received.
+func (m *metrics) hostLabel(host string) string {
+	if _, ok := m.received[host]; ok || len(m.received) < maxMetricHosts {
+		return host
+	}
+	return otherMetricHost
+}
+
+func (m *metrics) observeCertGen(d time.Duration) {
+	m.mtx.Lock()
+	m.certGen.observe(d.Seconds())
+	m.mtx.Unlock()
+}
+
+func (m *metrics) addClientTLSFailure() {
+	m.mtx.Lock()
+	m.clientTLSFailures++
+	m.mtx.Unlock()
+}
+
+// since returns what was counted since the last call.
+func (m *metrics) since() summaryTotals {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	t := summaryTotals{
+		requests: m.total.requests - m.reported.requests,
+		errors:   m.total.errors - m.reported.errors,
+		received: m.total.received - m.reported.received,
+		sent:     m.total.sent - m.reported.sent,
+	}
+	m.reported = m.total
+	return t
+}
+
+// promWriter writes the Prometheus text exposition format.
+type promWriter struct {
+	bytes.Buffer
+}
+
+func (w *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *promWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (w *promWriter) histogram(name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.bounds {
+		w.sample(name+"_bucket", labels+sep+`le="`+strconv.FormatFloat(b, 'g', -1, 64)+`"`, float64(h.counts[i]))
+	}
+	w.sample(name+"_bucket", labels+sep+`le="+Inf"`, float64(h.count))
+	w.sample(name+"_sum", labels, h.sum)
+	w.sample(name+"_count", labels, float64(h.count))
+}
+
+// label formats name="value" with value escaped.
+func label(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics renders every metric of d.
+func (d *Digger) writeMetrics(w *promWriter) {
+	s := d.Statistics()
+	w.header("digger_connections", "gauge", "Client connections being served.")
+	w.sample("digger_connections", "", float64(s.CurrentConnCnt))
+	w.header("digger_history_records", "gauge", "Records kept in the history.")
+	w.sample("digger_history_records", "", float64(d.history.Len()))
+
+	m := d.metrics
+	m.mtx.Lock()
+	w.header("digger_requests_total", "counter", "Finished exchanges by host, method and response status.")
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.host != b.host {
+			return a.host < b.host
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, l := range labels {
+		w.sample("digger_requests_total",
+			label("host", l.host)+","+label("method", l.method)+","+label("status", l.status),
+			float64(m.requests[l]))
+	}
+	w.header("digger_request_duration_seconds", "histogram", "Time from the request to the end of the response by host.")
+	hosts := make([]string, 0, len(m.latency))
+	for host := range m.latency {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		w.histogram("digger_request_duration_seconds", label("host", host), m.latency[host])
+	}
+	w.header("digger_received_bytes_total", "counter", "Body bytes received from clients by host.")
+	for _, host := range sortedKeys(m.received) {
+		w.sample("digger_received_bytes_total", label("host", host), float64(m.received[host]))
+	}
+	w.header("digger_sent_bytes_total", "counter", "Body bytes sent to clients by host.")
+	for _, host := range sortedKeys(m.sent) {
+		w.sample("digger_sent_bytes_total", label("host", host), float64(m.sent[host]))
+	}
+	w.header("digger_tls_handshake_failures_total", "counter", "Failed TLS handshakes with clients and upstreams.")
+	w.sample("digger_tls_handshake_failures_total", label("side", "client"), float64(m.clientTLSFailures))
+	w.sample("digger_tls_handshake_failures_total", label("side", "upstream"), float64(s.Pool.TLSFailures))
+	w.header("digger_cert_generation_seconds", "histogram", "Time to issue a MITM certificate on a cache miss.")
+	w.histogram("digger_cert_generation_seconds", "", m.certGen)
+	m.mtx.Unlock()
+
+	w.header("digger_cert_cache_total", "counter", "MITM certificate lookups by result.")
+	w.sample("digger_cert_cache_total", label("result", "hit"), float64(s.CertCacheHit))
+	w.sample("digger_cert_cache_total", label("result", "miss"), float64(s.CertCacheMiss))
+	w.header("digger_upstream_retries_total", "counter", "Requests sent again after a reused upstream conn broke.")
+	w.sample("digger_upstream_retries_total", "", float64(s.UpstreamRetries))
+	w.header("digger_pool_conns", "gauge", "Upstream conns by state.")
+	w.sample("digger_pool_conns", label("state", "active"), float64(s.Pool.Running))
+	w.sample("digger_pool_conns", label("state", "idle"), float64(s.Pool.Idle))
+	w.header("digger_pool_events_total", "counter", "Upstream conn pool events.")
+	for _, e := range []struct {
+		name string
+		v    int64
+	}{
+		{"hit", s.Pool.Hits}, {"miss", s.Pool.Misses}, {"stale", s.Pool.Stale},
+		{"evicted", s.Pool.Evicted}, {"expired", s.Pool.Expired}, {"wait", s.Pool.Waits},
+	} {
+		w.sample("digger_pool_events_total", label("event", e.name), float64(e.v))
+	}
+}
+
+// BuildMetricsHandler exposes the metrics in Prometheus text format.
+func (d *Digger) BuildMetricsHandler() func(writer http.ResponseWriter, _ *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		w := &promWriter{}
+		d.writeMetrics(w)
+		writer.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(w.Bytes())
+		if err != nil {
+			log.Error("metrics write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+const (
+	SummaryConns    = "conns"
+	SummaryRequests = "requests"
+	SummaryErrors   = "errors"
+	SummaryReceived = "in"
+	SummarySent     = "out"
+	SummaryPool     = "pool"
+	SummaryHistory  = "history"
+
+	defaultSummaryInterval = time.Minute
+)
+
+// SummaryFields are what the summary line can show, all of them by default.
+var SummaryFields = []string{
+	SummaryConns, SummaryRequests, SummaryErrors, SummaryReceived, SummarySent, SummaryPool, SummaryHistory,
+}
+
+// SummaryConfig is the periodic log line of digger's state and the traffic since the last line.
+type SummaryConfig struct {
+	// IntervalSec is how often the line is logged, default 60, negative turns it off.
+	IntervalSec int
+	// Fields picks and orders what the line shows, see SummaryFields.
+	Fields []string
+	// Quiet skips the line when no exchange finished since the last one.
+	Quiet bool
+}
+
+func (c *SummaryConfig) validate() error {
+	for _, f := range c.Fields {
+		known := false
+		for _, k := range SummaryFields {
+			known = known || f == k
+		}
+		if !known {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return nil
+}
+
+func (c *SummaryConfig) interval() time.Duration {
+	if c.IntervalSec == 0 {
+		return defaultSummaryInterval
+	}
+	return time.Duration(c.IntervalSec) * time.Second
+}
+
+// summary formats the summary line, "" when Quiet and nothing happened.
+func (d *Digger) summary() string {
+	t := d.metrics.since()
+	if d.Summary.Quiet && t.requests == 0 {
+		return ""
+	}
+	fields := d.Summary.Fields
+	if len(fields) == 0 {
+		fields = SummaryFields
+	}
+	s := d.Statistics()
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		switch f {
+		case SummaryConns:
+			parts = append(parts, fmt.Sprintf("conns:%d", s.CurrentConnCnt))
+		case SummaryRequests:
+			parts = append(parts, fmt.Sprintf("requests:+%d", t.requests))
+		case SummaryErrors:
+			parts = append(parts, fmt.Sprintf("errors:+%d", t.errors))
+		case SummaryReceived:
+			parts = append(parts, "in:+"+formatBytes(t.received))
+		case SummarySent:
+			parts = append(parts, "out:+"+formatBytes(t.sent))
+		case SummaryPool:
+			parts = append(parts, fmt.Sprintf("pool:%d active %d idle", s.Pool.Running, s.Pool.Idle))
+		case SummaryHistory:
+			parts = append(parts, fmt.Sprintf("history:%d", d.history.Len()))
+		}
+	}
+	return "[s]" + strings.Join(parts, " ")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// LogSummary logs the summary line every Summary.IntervalSec until d is shut down,
+// calling it again does not start another one.
+func (d *Digger) LogSummary() {
+	interval := d.Summary.interval()
+	if interval <= 0 {
+		return
+	}
+	d.summaryOnce.Do(func() {
+		go d.logSummary(interval)
+	})
+}
+
+func (d *Digger) logSummary(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if line := d.summary(); line != "" {
+				log.Info("%s", line)
+			}
+		case <-d.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigger_WriteMetrics(t *testing.T) {
+	d := NewDigger()
+	start := time.Now()
+	d.metrics.observe(&Record{
+		Req:            &RecordReq{Method: "POST", Host: "Example.com:443", BodyOrigin: []byte("abc")},
+		Resp:           &RecordResp{StatusCode: 201, BodyOrigin: []byte("hello")},
+		TimeStart:      start,
+		TimeRespFinish: start.Add(30 * time.Millisecond),
+	})
+	d.metrics.observe(&Record{
+		Req:       &RecordReq{Method: "GET", Host: "example.com"},
+		Error:     "dial fail",
+		TimeStart: start,
+	})
+	d.metrics.observe(&Record{
+		Req:    &RecordReq{Method: "CONNECT", Host: "tunnel.com:443"},
+		Tunnel: &RecordTunnel{BytesClientToServer: 10, BytesServerToClient: 20},
+	})
+	d.metrics.observeCertGen(3 * time.Millisecond)
+
+	w := &promWriter{}
+	d.writeMetrics(w)
+	out := w.String()
+	for _, line := range []string{
+		"# TYPE digger_requests_total counter",
+		`digger_requests_total{host="example.com",method="POST",status="201"} 1`,
+		`digger_requests_total{host="example.com",method="GET",status="error"} 1`,
+		`digger_requests_total{host="tunnel.com",method="CONNECT",status="tunnel"} 1`,
+		`digger_request_duration_seconds_bucket{host="example.com",le="0.025"} 0`,
+		`digger_request_duration_seconds_bucket{host="example.com",le="0.05"} 1`,
+		`digger_request_duration_seconds_count{host="example.com"} 1`,
+		`digger_received_bytes_total{host="example.com"} 3`,
+		`digger_sent_bytes_total{host="tunnel.com"} 20`,
+		`digger_cert_generation_seconds_bucket{le="0.005"} 1`,
+		`digger_cert_generation_seconds_count 1`,
+		`digger_history_records 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expect %q in\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, `digger_request_duration_seconds_count{host="tunnel.com"}`) {
+		t.Errorf("expect no latency for tunnels")
+	}
+
+	// hosts past the cap share one series
+	m := newMetrics()
+	for i := 0; i < maxMetricHosts+5; i++ {
+		m.observe(&Record{Req: &RecordReq{Method: "GET", Host: "h" + strconv.Itoa(i) + ".com"}, Resp: &RecordResp{StatusCode: 200}})
+	}
+	m.observe(&Record{Req: &RecordReq{Method: "GET", Host: "h0.com"}, Resp: &RecordResp{StatusCode: 200}})
+	if got := m.requests[requestLabels{host: otherMetricHost, method: "GET", status: "200"}]; got != 5 || len(m.received) != maxMetricHosts+1 {
+		t.Errorf("expect 5 in other and %d host series, got %d and %d", maxMetricHosts+1, got, len(m.received))
+	}
+	if got := m.requests[requestLabels{host: "h0.com", method: "GET", status: "200"}]; got != 2 {
+		t.Errorf("expect a known host kept after the cap, got %d", got)
+	}
+
+	d.Summary = SummaryConfig{Fields: []string{SummaryRequests, SummaryErrors, SummarySent}, Quiet: true}
+	if got := d.summary(); got != "[s]requests:+3 errors:+1 out:+25B" {
+		t.Errorf("unexpected summary %q", got)
+	}
+	if got := d.summary(); got != "" {
+		t.Errorf("expect a quiet summary without traffic, got %q", got)
+	}
+	if err := (&SummaryConfig{Fields: []string{"qps"}}).validate(); err == nil {
+		t.Errorf("expect an unknown field to fail")
+	}
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// MockMatchPath compares method, host and path.
+	MockMatchPath = "path"
+	// MockMatchQuery compares the query too, parameter order does not matter.
+	MockMatchQuery = "query"
+	// MockMatchBody compares the request body too.
+	MockMatchBody = "body"
+
+	// MockUnmatchedPassthrough sends unmatched requests upstream.
+	MockUnmatchedPassthrough = "passthrough"
+	// MockUnmatchedNotFound answers unmatched requests with 404.
+	MockUnmatchedNotFound = "404"
+)
+
+// MockConfig turns digger into a stub server answering with recorded responses.
+type MockConfig struct {
+	// Session is a file saved from GET /history, empty takes the current history.
+	Session string
+	// Hosts are hostPatterns and Paths are path.Match patterns selecting the records, empty selects all.
+	Hosts []string
+	Paths []string
+	// Match is how strictly requests are compared: path, query (default) or body.
+	Match string
+	// Sequence answers repeated calls with the recorded responses in order and repeats the last one,
+	// otherwise the first recorded response always answers.
+	Sequence bool
+	// Unmatched is passthrough (default) or 404.
+	Unmatched string
+}
+
+func (c *MockConfig) validate() error {
+	switch c.Match {
+	case "":
+		c.Match = MockMatchQuery
+	case MockMatchPath, MockMatchQuery, MockMatchBody:
+	default:
+		return fmt.Errorf("unknown match %q", c.Match)
+	}
+	switch c.Unmatched {
+	case "":
+		c.Unmatched = MockUnmatchedPassthrough
+	case MockUnmatchedPassthrough, MockUnmatchedNotFound:
+	default:
+		return fmt.Errorf("unknown unmatched %q", c.Unmatched)
+	}
+	return nil
+}
+
+// key is what requests are matched on at the strictness of c.
+func (c *MockConfig) key(method, host string, u *url.URL, body []byte) string {
+	k := method + " " + strings.ToLower(stripPort(host)) + u.Path
+	if c.Match == MockMatchQuery || c.Match == MockMatchBody {
+		if q := u.Query(); len(q) > 0 {
+			// Encode sorts by key
+			k += "?" + q.Encode()
+		}
+	}
+	if c.Match == MockMatchBody && len(body) > 0 {
+		sum := sha256.Sum256(body)
+		k += " body:" + hex.EncodeToString(sum[:8])
+	}
+	return k
+}
+
+func (c *MockConfig) selects(r *Record) bool {
+	if len(c.Hosts) > 0 && !hostPatterns(c.Hosts).Match(r.Req.Host) {
+		return false
+	}
+	if len(c.Paths) == 0 {
+		return true
+	}
+	for _, p := range c.Paths {
+		if ok, err := path.Match(p, r.Req.URL.Path); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+type mock struct {
+	mtx sync.Mutex
+	// sets are the mocks each client loaded when Clients.Scoped, the shared one is ""
+	sets map[string]*mockSet
+}
+
+type mockSet struct {
+	config  MockConfig
+	entries map[string]*mockEntry
+}
+
+type mockEntry struct {
+	responses []*RecordResp
+	next      int
+	hits      int
+}
+
+// load replaces the stubs of client with the selected records and enables its mock.
+func (m *mock) load(client string, c MockConfig, history []Record) (int, error) {
+	if err := c.validate(); err != nil {
+		return 0, err
+	}
+	if c.Session != "" {
+		j, err := ioutil.ReadFile(c.Session)
+		if err != nil {
+			return 0, err
+		}
+		history = nil
+		if err = json.Unmarshal(j, &history); err != nil {
+			return 0, fmt.Errorf("parse session %s fail: %s", c.Session, err.Error())
+		}
+	}
+	entries := map[string]*mockEntry{}
+	cnt := 0
+	for i := range history {
+		r := &history[i]
+		// skip what digger answered itself, they are not real upstream traffic
+		if r.Req == nil || r.Req.URL == nil || r.Resp == nil || r.Tunnel != nil ||
+			r.Mock != "" || r.Local != "" || r.Fault != "" {
+			continue
+		}
+		if !c.selects(r) {
+			continue
+		}
+		k := c.key(r.Req.Method, r.Req.Host, r.Req.URL, r.Req.BodyOrigin)
+		e, ok := entries[k]
+		if !ok {
+			e = &mockEntry{}
+			entries[k] = e
+		}
+		// hooks and rules apply to the replayed response again, start from upstream's
+		resp := r.Resp
+		if r.UpstreamResp != nil {
+			resp = r.UpstreamResp
+		}
+		e.responses = append(e.responses, resp)
+		cnt++
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.sets == nil {
+		m.sets = map[string]*mockSet{}
+	}
+	m.sets[client] = &mockSet{config: c, entries: entries}
+	return cnt, nil
+}
+
+func (m *mock) stop(client string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.sets, client)
+}
+
+func (m *mock) rewind(client string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if set, ok := m.sets[client]; ok {
+		for _, e := range set.entries {
+			e.next = 0
+		}
+	}
+}
+
+// respond answers req with a recorded response, nil if it goes upstream.
+// The mock of the record's client is used if it loaded one, the shared one otherwise.
+func (m *mock) respond(req *http.Request, record *Record) *http.Response {
+	m.mtx.Lock()
+	set, ok := m.sets[record.Client]
+	if !ok {
+		set, ok = m.sets[""]
+	}
+	if !ok {
+		m.mtx.Unlock()
+		return nil
+	}
+	c := set.config
+	m.mtx.Unlock()
+
+	var body []byte
+	if c.Match == MockMatchBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Error("read body for mock fail: %s", err.Error())
+		}
+		// the body is recorded already, upstream still gets it if nothing matches
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	k := c.key(req.Method, req.Host, req.URL, body)
+
+	m.mtx.Lock()
+	e, ok := set.entries[k]
+	var recorded *RecordResp
+	n := 0
+	if ok {
+		n = e.next
+		recorded = e.responses[n]
+		if c.Sequence && e.next < len(e.responses)-1 {
+			e.next++
+		}
+		e.hits++
+	}
+	m.mtx.Unlock()
+
+	if !ok {
+		if c.Unmatched == MockUnmatchedNotFound {
+			record.Mock = "unmatched " + k
+			return newTextResponse(req, http.StatusNotFound, "digger: no mock for "+k+"\n")
+		}
+		return nil
+	}
+	record.Mock = k + " #" + strconv.Itoa(n+1)
+	header := http.Header{}
+	for name, vs := range recorded.Header {
+		header[name] = append([]string(nil), vs...)
+	}
+	header.Del("Transfer-Encoding")
+	return newResponse(req, recorded.StatusCode, header, recorded.body())
+}
+
+type mockState struct {
+	Enabled bool
+	Config  MockConfig
+	Entries []mockEntryState
+}
+
+type mockEntryState struct {
+	Key       string
+	Responses int
+	Next      int
+	Hits      int
+}
+
+// BuildHandler shows the mock state on GET and loads a MockConfig on POST,
+// records come from its Session or from history. Both are of the caller's mock.
+func (m *mock) BuildHandler(history *_recordList, scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		client := scope(req)
+		if req.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				log.Error("read mock body fail: %s", err.Error())
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var c MockConfig
+			if err = json.Unmarshal(body, &c); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			cnt, err := m.load(client, c, history.snapshotOf(client))
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			log.Info("mock loaded %d records", cnt)
+		}
+		m.mtx.Lock()
+		state := mockState{Entries: []mockEntryState{}}
+		if set, ok := m.sets[client]; ok {
+			state.Enabled, state.Config = true, set.config
+			for k, e := range set.entries {
+				state.Entries = append(state.Entries, mockEntryState{
+					Key:       k,
+					Responses: len(e.responses),
+					Next:      e.next,
+					Hits:      e.hits,
+				})
+			}
+		}
+		m.mtx.Unlock()
+		sort.Slice(state.Entries, func(i, j int) bool {
+			return state.Entries[i].Key < state.Entries[j].Key
+		})
+		j, _ := json.Marshal(state)
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("mock write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+func (m *mock) BuildStopHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		m.stop(scope(req))
+		log.Info("mock stopped")
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+func (m *mock) BuildRewindHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		m.rewind(scope(req))
+		writer.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMock_Respond(t *testing.T) {
+	u, _ := url.Parse("http://api.test/user?b=2&a=1")
+	history := []Record{
+		{Req: &RecordReq{Method: "GET", URL: u, Host: "api.test"}, Resp: &RecordResp{StatusCode: 200, BodyOrigin: []byte("first")}},
+		{Req: &RecordReq{Method: "GET", URL: u, Host: "api.test"}, Resp: &RecordResp{StatusCode: 500, Body: "second"}},
+		{Req: &RecordReq{Method: "GET", URL: u, Host: "api.test"}, Resp: &RecordResp{StatusCode: 418}, Fault: "status:418"},
+	}
+	var m mock
+	cnt, err := m.load("", MockConfig{Sequence: true, Unmatched: MockUnmatchedNotFound}, history)
+	if err != nil || cnt != 2 {
+		t.Fatalf("load %d records, err %v", cnt, err)
+	}
+	for i, expect := range []string{"200 first", "500 second", "500 second", "404 "} {
+		target := "http://api.test:80/user?a=1&b=2"
+		if i == 3 {
+			target = "http://api.test/user"
+		}
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		var record Record
+		resp := m.respond(req, &record)
+		if resp == nil {
+			t.Fatalf("request %d not answered", i)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		got := resp.Status[:4] + string(body)
+		if !strings.HasPrefix(got, expect) {
+			t.Errorf("request %d got %q, expect %q", i, got, expect)
+		}
+		if record.Mock == "" {
+			t.Errorf("request %d not marked", i)
+		}
+	}
+}
+
+func TestMock_SessionBinaryBody(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\xff\xfe")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+	defer upstream.Close()
+	d, stop := startTestDigger(t)
+	defer stop()
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL + "/logo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	session, _ := json.Marshal(d.History())
+	file := filepath.Join(dir, "session.json")
+	if err = ioutil.WriteFile(file, session, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var m mock
+	if cnt, err := m.load("", MockConfig{Session: file}, nil); err != nil || cnt != 1 {
+		t.Fatalf("load %d records, err %v", cnt, err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/logo.png", nil)
+	resp = m.respond(req, &Record{})
+	if resp == nil {
+		t.Fatal("request not answered")
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); !bytes.Equal(body, png) {
+		t.Errorf("expect the recorded bytes, got %q", body)
+	}
+}
+
+func TestDigger_MockHttpsOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the host does not resolve, the mock must answer without dialing it
+	u, _ := url.Parse("https://api.invalid/user")
+	session, _ := json.Marshal([]Record{
+		{Req: &RecordReq{Method: "GET", URL: u, Host: "api.invalid"}, Resp: &RecordResp{StatusCode: 200, Body: "mocked"}},
+	})
+	file := filepath.Join(dir, "session.json")
+	if err = ioutil.WriteFile(file, session, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, stop := startTestDigger(t, func(d *Digger) {
+		d.Mock = &MockConfig{Session: file, Unmatched: MockUnmatchedNotFound}
+	})
+	defer stop()
+
+	client := newMITMClient(d)
+	for target, expect := range map[string]string{
+		"https://api.invalid/user":  "200 mocked",
+		"https://api.invalid/other": "404 digger: no mock for GET api.invalid/other\n",
+	} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("get %s: %s", target, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if got := resp.Status[:4] + string(body); got != expect {
+			t.Errorf("get %s got %q, expect %q", target, got, expect)
+		}
+	}
+}
@@ -7,20 +7,23 @@ import (
 
 type noProxyHandler struct {
 	router map[string]http.HandlerFunc
+	// public pages need no admin token
+	public map[string]bool
 }
 
 func NewNoProxyHandler() *noProxyHandler {
 	return &noProxyHandler{
 		router: map[string]http.HandlerFunc{},
+		public: map[string]bool{},
 	}
 }
 
 func (n *noProxyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	if f, ok := n.router[request.RequestURI]; ok {
+	if f, ok := n.router[request.URL.Path]; ok {
 		f(writer, request)
 		return
 	}
-	log.Warn("no proxy handler uri(%s) not found.", request.RequestURI)
+	log.Warn("no proxy handler uri(%s) not found.", request.URL.Path)
 	writer.WriteHeader(http.StatusNotFound)
 	_, err := writer.Write([]byte("not found"))
 	if err != nil {
@@ -33,3 +36,18 @@ func (n *noProxyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Req
 func (n *noProxyHandler) Register(uri string, handler http.HandlerFunc) {
 	n.router[uri] = handler
 }
+
+// RegisterPublic registers a page that stays open when AdminTokens are set.
+func (n *noProxyHandler) RegisterPublic(uri string, handler http.HandlerFunc) {
+	n.Register(uri, handler)
+	n.public[uri] = true
+}
+
+func (n *noProxyHandler) isPublic(uri string) bool {
+	return n.public[uri]
+}
+
+// Handle serves handler at path of digger's own pages, like /history. Call it before Start.
+func (d *Digger) Handle(path string, handler http.HandlerFunc) {
+	d.noProxyHandler.Register(path, handler)
+}
@@ -0,0 +1,49 @@
+package proxy
+
+// Option configures a Digger in NewDigger.
+type Option func(d *Digger)
+
+// WithAddress sets where Start listens, port 0 picks a free one, see Digger.Addr.
+func WithAddress(address string, port int16) Option {
+	return func(d *Digger) {
+		d.Address = address
+		d.Port = port
+	}
+}
+
+// WithConfigDir sets the dir holding config.json and the root CA.
+func WithConfigDir(dir string) Option {
+	return func(d *Digger) {
+		d.ConfigDir = dir
+	}
+}
+
+// WithCA loads the root CA from certPath and keyPath, they are created if missing.
+func WithCA(certPath, keyPath string) Option {
+	return func(d *Digger) {
+		d.CACertPath = certPath
+		d.CAKeyPath = keyPath
+	}
+}
+
+// WithMitm limits interception to include if not empty and never intercepts exclude.
+func WithMitm(include, exclude []string) Option {
+	return func(d *Digger) {
+		d.MitmInclude = include
+		d.MitmExclude = exclude
+	}
+}
+
+// WithUpstreamVerify sets how server certificates are checked, e.g. UpstreamVerifySkip for test servers.
+func WithUpstreamVerify(verify string) Option {
+	return func(d *Digger) {
+		d.UpstreamVerify = verify
+	}
+}
+
+// WithHook adds h, hooks run in the order they are added.
+func WithHook(h Hook) Option {
+	return func(d *Digger) {
+		d.hooks = append(d.hooks, h)
+	}
+}
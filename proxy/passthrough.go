@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/er1c-zh/go-now/log"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultAutoPassthroughThreshold = 3
+	sniffClientHelloTimeout         = 10 * time.Second
+)
+
+var errSniffDone = errors.New("client hello sniffed")
+
+// passthrough decides which CONNECT tunnels are intercepted.
+// Hosts whose clients keep rejecting our certificate, e.g. pinned apps,
+// are switched to passthrough automatically.
+type passthrough struct {
+	mtx      sync.Mutex
+	failures map[string]int
+	auto     map[string]time.Time
+}
+
+func newPassthrough() passthrough {
+	return passthrough{
+		failures: map[string]int{},
+		auto:     map[string]time.Time{},
+	}
+}
+
+func (d *Digger) shouldPassthrough(host string) bool {
+	host = stripPort(host)
+	if hostPatterns(d.MitmExclude).Match(host) {
+		return true
+	}
+	if len(d.MitmInclude) > 0 && !hostPatterns(d.MitmInclude).Match(host) {
+		return true
+	}
+	d.passthrough.mtx.Lock()
+	defer d.passthrough.mtx.Unlock()
+	_, ok := d.passthrough.auto[host]
+	return ok
+}
+
+func (d *Digger) recordHandshakeResult(host string, err error) {
+	host = stripPort(host)
+	d.passthrough.mtx.Lock()
+	defer d.passthrough.mtx.Unlock()
+	if err == nil {
+		delete(d.passthrough.failures, host)
+		return
+	}
+	if d.AutoPassthroughThreshold <= 0 {
+		return
+	}
+	d.passthrough.failures[host]++
+	if d.passthrough.failures[host] >= d.AutoPassthroughThreshold {
+		log.Info("client handshake with %s failed %d times, pass it through from now on",
+			host, d.passthrough.failures[host])
+		delete(d.passthrough.failures, host)
+		d.passthrough.auto[host] = time.Now()
+	}
+}
+
+func (p *passthrough) BuildHandler() func(writer http.ResponseWriter, _ *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		p.mtx.Lock()
+		j, _ := json.Marshal(p.auto)
+		p.mtx.Unlock()
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("passthrough write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+func (p *passthrough) BuildCleanHandler() func(writer http.ResponseWriter, _ *http.Request) {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		p.mtx.Lock()
+		p.failures = map[string]int{}
+		p.auto = map[string]time.Time{}
+		p.mtx.Unlock()
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// tunnel blindly copies bytes between client and the CONNECT target.
+func (d *Digger) tunnel(connToClient net.Conn, clientReader *bufio.Reader, __req *http.Request) {
+	record := Record{
+		Client: d.clientOf(__req, proxyUserOf(__req)),
+		User:   proxyUserOf(__req),
+		Req: &RecordReq{
+			Method:     __req.Method,
+			URL:        __req.URL,
+			Proto:      __req.Proto,
+			ProtoMajor: __req.ProtoMajor,
+			ProtoMinor: __req.ProtoMinor,
+			Header:     __req.Header,
+			Host:       __req.Host,
+			RemoteAddr: __req.RemoteAddr,
+			RequestURI: __req.RequestURI,
+		},
+		TimeStart: time.Now(),
+		IsHttps:   true,
+		Tunnel:    &RecordTunnel{},
+	}
+	defer func() {
+		record.TimeRespFinish = time.Now()
+		record.Tunnel.Duration = record.TimeRespFinish.Sub(record.TimeStart)
+		d.addRecord(record)
+	}()
+
+	sni, hello, err := sniffClientHello(connToClient, clientReader)
+	if err != nil {
+		log.Warn("sniff client hello of %s fail: %s", __req.Host, err.Error())
+	}
+	record.Tunnel.SNI = sni
+
+	addr := __req.URL.Host
+	if __req.URL.Port() == "" {
+		addr += ":443"
+	}
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		log.Error("dial (%s) fail: %s", addr, err.Error())
+		return
+	}
+	conn2Server := &throttledConn{Conn: raw, upstream: true, profile: d.throttleUpstream(__req)}
+	defer func() {
+		_ = conn2Server.Close()
+	}()
+
+	var toServer int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := io.Copy(conn2Server, io.MultiReader(bytes.NewReader(hello), clientReader))
+		atomic.StoreInt64(&toServer, n)
+		if err != nil {
+			log.Debug("tunnel copy to server fail: %s", err.Error())
+			// the client conn broke or was closed on shutdown, don't wait for the server
+			_ = conn2Server.Close()
+		}
+		closeWrite(conn2Server)
+	}()
+	toClient, err := io.Copy(connToClient, conn2Server)
+	if err != nil {
+		log.Debug("tunnel copy to client fail: %s", err.Error())
+	}
+	closeWrite(connToClient)
+	// the server is gone, don't wait for the client to hang up
+	_ = connToClient.SetReadDeadline(time.Now())
+	<-done
+	record.Tunnel.BytesClientToServer = atomic.LoadInt64(&toServer)
+	record.Tunnel.BytesServerToClient = toClient
+}
+
+// sniffClientHello reads the TLS ClientHello from r to learn the SNI,
+// returning the bytes consumed so they can be replayed to the server.
+func sniffClientHello(conn net.Conn, r io.Reader) (string, []byte, error) {
+	buf := new(bytes.Buffer)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffClientHelloTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	var sni string
+	err := tls.Server(&sniffConn{Conn: conn, r: io.TeeReader(r, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSniffDone
+		},
+	}).Handshake()
+	if err != nil && !errors.Is(err, errSniffDone) {
+		return "", buf.Bytes(), err
+	}
+	return sni, buf.Bytes(), nil
+}
+
+// sniffConn reads from r and swallows writes, so the alert sent
+// by an aborted handshake never reaches the client.
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// bufferedConn is a hijacked conn whose reads go through
+// the bufio.Reader returned by Hijack, so nothing buffered is lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/er1c-zh/go-now/log"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// pcapng export synthesizes one TCP flow per record out of the plaintext
+// request and response, so Wireshark's HTTP dissector works without any keys.
+// HTTPS is exported decrypted, every flow uses server port 80 for that reason.
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	linkTypeRaw          = 101 // raw IPv4/IPv6, no link layer header
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	pcapTCPMSS          = 1460
+	pcapServerPort      = 80
+	pcapFirstClientPort = 40000
+)
+
+func (l *_recordList) BuildPcapngHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		records := l.snapshotOf(scope(req))
+
+		writer.Header().Set("content-type", "application/x-pcapng")
+		writer.Header().Set("content-disposition", "attachment; filename=\"digger.pcapng\"")
+		writer.WriteHeader(http.StatusOK)
+		if err := writePcapng(writer, records); err != nil {
+			log.Error("write pcapng fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+func writePcapng(w io.Writer, records []Record) error {
+	p := &pcapngWriter{w: w}
+	p.writeBlock(pcapngBlockSHB, func(b *bytes.Buffer) {
+		_ = binary.Write(b, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+		_ = binary.Write(b, binary.LittleEndian, uint16(1)) // major
+		_ = binary.Write(b, binary.LittleEndian, uint16(0)) // minor
+		_ = binary.Write(b, binary.LittleEndian, int64(-1)) // section length unknown
+	})
+	p.writeBlock(pcapngBlockIDB, func(b *bytes.Buffer) {
+		_ = binary.Write(b, binary.LittleEndian, uint16(linkTypeRaw))
+		_ = binary.Write(b, binary.LittleEndian, uint16(0)) // reserved
+		_ = binary.Write(b, binary.LittleEndian, uint32(0)) // snap length unlimited
+	})
+	for i, record := range records {
+		if record.Req == nil || record.Tunnel != nil {
+			continue
+		}
+		newTCPFlow(record, i).write(p, record)
+		if p.err != nil {
+			return p.err
+		}
+	}
+	return p.err
+}
+
+type pcapngWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *pcapngWriter) writeBlock(blockType uint32, body func(b *bytes.Buffer)) {
+	if p.err != nil {
+		return
+	}
+	b := new(bytes.Buffer)
+	body(b)
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+	total := uint32(b.Len() + 12)
+	out := new(bytes.Buffer)
+	_ = binary.Write(out, binary.LittleEndian, blockType)
+	_ = binary.Write(out, binary.LittleEndian, total)
+	out.Write(b.Bytes())
+	_ = binary.Write(out, binary.LittleEndian, total)
+	_, p.err = p.w.Write(out.Bytes())
+}
+
+func (p *pcapngWriter) writePacket(ts time.Time, data []byte) {
+	p.writeBlock(pcapngBlockEPB, func(b *bytes.Buffer) {
+		us := uint64(ts.UnixNano() / int64(time.Microsecond))
+		_ = binary.Write(b, binary.LittleEndian, uint32(0)) // interface id
+		_ = binary.Write(b, binary.LittleEndian, uint32(us>>32))
+		_ = binary.Write(b, binary.LittleEndian, uint32(us))
+		_ = binary.Write(b, binary.LittleEndian, uint32(len(data)))
+		_ = binary.Write(b, binary.LittleEndian, uint32(len(data)))
+		b.Write(data)
+	})
+}
+
+type tcpFlow struct {
+	clientIP, serverIP     net.IP
+	clientPort, serverPort uint16
+	clientSeq, serverSeq   uint32
+	ipID                   uint16
+}
+
+func newTCPFlow(record Record, index int) *tcpFlow {
+	f := &tcpFlow{
+		clientIP:   net.IPv4(10, 0, 0, 1).To4(),
+		clientPort: uint16(pcapFirstClientPort + index%20000),
+		serverPort: pcapServerPort,
+	}
+	if host, _, err := net.SplitHostPort(record.Req.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			f.clientIP = ip
+		}
+	}
+	host := stripPort(record.Req.Host)
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		f.serverIP = ip
+	} else {
+		// a stable fake address per host keeps conversations grouped in Wireshark
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(host))
+		sum := h.Sum32()
+		f.serverIP = net.IPv4(10, 128|byte(sum>>16)&0x7f, byte(sum>>8), byte(sum)|1).To4()
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(record.TimeStart.String() + record.Req.Host))
+	f.clientSeq = h.Sum32()
+	f.serverSeq = f.clientSeq*2654435761 + 1
+	return f
+}
+
+func (f *tcpFlow) write(p *pcapngWriter, record Record) {
+	start := record.TimeStart
+	reqFinish := record.TimeReqFinish
+	if reqFinish.Before(start) {
+		reqFinish = start
+	}
+	respFinish := record.TimeRespFinish
+	if respFinish.Before(reqFinish) {
+		respFinish = reqFinish
+	}
+	tick := time.Microsecond
+
+	// handshake
+	p.writePacket(start, f.packet(true, tcpFlagSYN, nil))
+	f.clientSeq++
+	p.writePacket(start.Add(tick), f.packet(false, tcpFlagSYN|tcpFlagACK, nil))
+	f.serverSeq++
+	p.writePacket(start.Add(2*tick), f.packet(true, tcpFlagACK, nil))
+
+	f.send(p, true, start.Add(3*tick), reqFinish, serializeRecordReq(record.Req))
+	p.writePacket(reqFinish.Add(tick), f.packet(false, tcpFlagACK, nil))
+
+	end := reqFinish.Add(2 * tick)
+	if record.Resp != nil {
+		f.send(p, false, end, respFinish, serializeRecordResp(record.Resp))
+		end = respFinish.Add(tick)
+		p.writePacket(end, f.packet(true, tcpFlagACK, nil))
+	}
+
+	// teardown
+	p.writePacket(end.Add(tick), f.packet(true, tcpFlagFIN|tcpFlagACK, nil))
+	f.clientSeq++
+	p.writePacket(end.Add(2*tick), f.packet(false, tcpFlagFIN|tcpFlagACK, nil))
+	f.serverSeq++
+	p.writePacket(end.Add(3*tick), f.packet(true, tcpFlagACK, nil))
+}
+
+// send splits data into MSS sized segments spread evenly between from and to.
+func (f *tcpFlow) send(p *pcapngWriter, fromClient bool, from, to time.Time, data []byte) {
+	n := (len(data) + pcapTCPMSS - 1) / pcapTCPMSS
+	for i := 0; i < n; i++ {
+		end := (i + 1) * pcapTCPMSS
+		if end > len(data) {
+			end = len(data)
+		}
+		segment := data[i*pcapTCPMSS : end]
+		ts := from
+		if n > 1 {
+			ts = from.Add(to.Sub(from) * time.Duration(i) / time.Duration(n-1))
+		}
+		p.writePacket(ts, f.packet(fromClient, tcpFlagPSH|tcpFlagACK, segment))
+		if fromClient {
+			f.clientSeq += uint32(len(segment))
+		} else {
+			f.serverSeq += uint32(len(segment))
+		}
+	}
+}
+
+// packet builds an IPv4 + TCP packet with valid checksums.
+func (f *tcpFlow) packet(fromClient bool, flags byte, payload []byte) []byte {
+	srcIP, dstIP := f.clientIP, f.serverIP
+	srcPort, dstPort := f.clientPort, f.serverPort
+	seq, ack := f.clientSeq, f.serverSeq
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	pseudo := make([]byte, 12, 12+len(tcp))
+	copy(pseudo[0:], srcIP)
+	copy(pseudo[4:], dstIP)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	f.ipID++
+	binary.BigEndian.PutUint16(ip[4:], f.ipID)
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], srcIP)
+	copy(ip[16:], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip))
+	return append(ip, tcp...)
+}
+
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func serializeRecordReq(r *RecordReq) []byte {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	req := &http.Request{
+		Method:        r.Method,
+		URL:           &u,
+		Host:          r.Host,
+		Header:        r.Header,
+		ContentLength: int64(len(r.BodyOrigin)),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.BodyOrigin)),
+	}
+	buf := new(bytes.Buffer)
+	if err := req.Write(buf); err != nil {
+		log.Warn("serialize request fail: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+func serializeRecordResp(r *RecordResp) []byte {
+	resp := &http.Response{
+		Status:        r.Status,
+		StatusCode:    r.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.Header,
+		ContentLength: int64(len(r.BodyOrigin)),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.BodyOrigin)),
+	}
+	buf := new(bytes.Buffer)
+	if err := resp.Write(buf); err != nil {
+		log.Warn("serialize response fail: %s", err.Error())
+	}
+	return buf.Bytes()
+}
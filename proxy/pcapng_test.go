@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWritePcapng(t *testing.T) {
+	u, _ := url.Parse("/path?q=1")
+	now := time.Now()
+	record := Record{
+		Req: &RecordReq{
+			Method:     "POST",
+			URL:        u,
+			Header:     http.Header{"User-Agent": []string{"test"}},
+			Host:       "example.com",
+			RemoteAddr: "192.168.1.2:51234",
+			BodyOrigin: bytes.Repeat([]byte("a"), 3000),
+		},
+		Resp: &RecordResp{
+			Status:     "200 OK",
+			StatusCode: 200,
+			Header:     http.Header{},
+			BodyOrigin: []byte("ok"),
+		},
+		TimeStart:      now,
+		TimeReqFinish:  now.Add(10 * time.Millisecond),
+		TimeRespFinish: now.Add(30 * time.Millisecond),
+		IsHttps:        true,
+	}
+	buf := new(bytes.Buffer)
+	if err := writePcapng(buf, []Record{record}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	data := buf.Bytes()
+	var packets [][]byte
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data)
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total%4 != 0 || int(total) > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != total {
+			t.Errorf("malformed block of type %x", blockType)
+			return
+		}
+		if blockType == pcapngBlockEPB {
+			capLen := binary.LittleEndian.Uint32(data[20:])
+			packets = append(packets, data[28:28+capLen])
+		}
+		data = data[total:]
+	}
+	// 3 handshake, 3 request segments, ack, 1 response segment, ack, 3 teardown
+	if len(packets) != 12 {
+		t.Errorf("expect 12 packets, got %d", len(packets))
+	}
+	for i, p := range packets {
+		if internetChecksum(p[:20]) != 0 {
+			t.Errorf("packet %d has bad ip checksum", i)
+		}
+	}
+	if !bytes.HasPrefix(packets[3][40:], []byte("POST /path?q=1 HTTP/1.1\r\nHost: example.com\r\n")) {
+		t.Errorf("unexpected request payload: %q", packets[3][40:80])
+	}
+}
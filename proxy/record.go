@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/er1c-zh/digger/util"
 	"github.com/er1c-zh/go-now/log"
@@ -9,9 +10,11 @@ import (
 	"net/url"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-type _recordReq struct {
+// RecordReq is a captured request as digger received it.
+type RecordReq struct {
 	Method        string
 	URL           *url.URL
 	Proto         string
@@ -27,6 +30,18 @@ type _recordReq struct {
 	// todo multipart form
 }
 
+// CaptureRequest records src, its body is kept as it is read from the returned request.
+// Unlike the proxy it leaves the request as it is.
+func CaptureRequest(src *http.Request) (*http.Request, *RecordReq, error) {
+	r := captureRequest(src)
+	return src, r, nil
+}
+
+// CaptureResponse records src, its body is kept as it is read from src.Body.
+func CaptureResponse(src *http.Response) (*RecordResp, error) {
+	return recordRespFromHttpResp(src)
+}
+
 type teeReadCloser struct {
 	originReader io.ReadCloser
 	tee          io.Reader
@@ -47,30 +62,59 @@ func (t *teeReadCloser) Close() error {
 	return t.originReader.Close()
 }
 
-func wrapRequest(src *http.Request) (*http.Request, *_recordReq, error) {
-	r := &_recordReq{
+func wrapRequest(src *http.Request) (*http.Request, *RecordReq, error) {
+	r := captureRequest(src)
+	src = util.WrapProxyRequest(src)
+	return src, r, nil
+}
+
+// captureRequest records src and tees its body into the record.
+func captureRequest(src *http.Request) *RecordReq {
+	u := *src.URL
+	r := &RecordReq{
 		Method:        src.Method,
-		URL:           src.URL,
+		URL:           &u,
 		Proto:         src.Proto,
 		ProtoMajor:    src.ProtoMajor,
 		ProtoMinor:    src.ProtoMinor,
-		Header:        src.Header,
+		Header:        cloneHeader(src.Header),
 		ContentLength: src.ContentLength,
 		Host:          src.Host,
 		RemoteAddr:    src.RemoteAddr,
 		RequestURI:    src.RequestURI,
 	}
 	src.Body = TeeReadCloser(src.Body, r)
-	src = util.WrapProxyRequest(src)
-	return src, r, nil
+	return r
 }
 
-func (r *_recordReq) Write(p []byte) (n int, err error) {
+// recordUpstreamReq captures req as it is written upstream, its body as it is read.
+func recordUpstreamReq(req *http.Request) *RecordReq {
+	u := *req.URL
+	r := &RecordReq{
+		Method: req.Method,
+		URL:    &u,
+		// req.Write always sends HTTP/1.1
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(req.Header),
+		ContentLength: req.ContentLength,
+		Host:          req.Host,
+		RequestURI:    u.RequestURI(),
+	}
+	if req.Body != nil {
+		req.Body = TeeReadCloser(req.Body, r)
+	}
+	return r
+}
+
+func (r *RecordReq) Write(p []byte) (n int, err error) {
 	r.BodyOrigin = append(r.BodyOrigin, p...)
 	return len(p), nil
 }
 
-type _recordResp struct {
+// RecordResp is a captured response as upstream sent it.
+type RecordResp struct {
 	Status        string
 	StatusCode    int
 	Proto         string
@@ -81,16 +125,19 @@ type _recordResp struct {
 	Cookies       []*http.Cookie
 	BodyOrigin    []byte `json:"-"`
 	Body          string
+	// BodyRaw keeps a body that is not valid UTF-8 for saved sessions,
+	// Body has U+FFFD in place of its invalid bytes.
+	BodyRaw []byte `json:",omitempty"`
 }
 
-func recordRespFromHttpResp(src *http.Response) (*_recordResp, error) {
-	r := &_recordResp{
+func recordRespFromHttpResp(src *http.Response) (*RecordResp, error) {
+	r := &RecordResp{
 		Status:        src.Status,
 		StatusCode:    src.StatusCode,
 		Proto:         src.Proto,
 		ProtoMajor:    src.ProtoMajor,
 		ProtoMinor:    src.ProtoMinor,
-		Header:        src.Header,
+		Header:        cloneHeader(src.Header),
 		ContentLength: src.ContentLength,
 		Cookies:       src.Cookies(),
 		BodyOrigin:    nil,
@@ -99,39 +146,98 @@ func recordRespFromHttpResp(src *http.Response) (*_recordResp, error) {
 	return r, nil
 }
 
-func (r *_recordResp) Write(p []byte) (n int, err error) {
+func (r *RecordResp) Write(p []byte) (n int, err error) {
 	r.BodyOrigin = append(r.BodyOrigin, p...)
 	return len(p), nil
 }
 
-type _record struct {
-	Req  *_recordReq
-	Resp *_recordResp
+// fillBody sets the serialized views of BodyOrigin.
+func (r *RecordResp) fillBody() {
+	r.Body = string(r.BodyOrigin)
+	r.BodyRaw = nil
+	if !utf8.Valid(r.BodyOrigin) {
+		r.BodyRaw = r.BodyOrigin
+	}
+}
+
+// body is the body as received, also for a record loaded from a saved session.
+func (r *RecordResp) body() []byte {
+	if r.BodyOrigin != nil {
+		return r.BodyOrigin
+	}
+	if r.BodyRaw != nil {
+		return r.BodyRaw
+	}
+	return []byte(r.Body)
+}
+
+// Record is one exchange through digger, what /history lists.
+type Record struct {
+	// Req is the request as the client sent it, Resp the response as the client got it.
+	Req  *RecordReq
+	Resp *RecordResp
+	// UpstreamReq is the request as sent upstream, UpstreamResp the response as upstream sent it.
+	// Both are nil when digger answered itself, /history/diff shows what changed in transit.
+	UpstreamReq  *RecordReq  `json:",omitempty"`
+	UpstreamResp *RecordResp `json:",omitempty"`
 
 	TimeStart      time.Time
 	TimeReqFinish  time.Time
 	TimeRespFinish time.Time
+	// Timing breaks the exchange into waterfall phases.
+	Timing *RecordTiming `json:",omitempty"`
 
 	IsHttps bool
+	// TLS is the handshake of both legs, shared by all records of the connection.
+	TLS *TLSSession `json:",omitempty"`
+
+	// Error is why the exchange failed, e.g. the upstream certificate did not verify.
+	Error string `json:",omitempty"`
+
+	// Tunnel is set instead of Resp when a CONNECT was passed through without MITM.
+	Tunnel *RecordTunnel `json:",omitempty"`
+
+	// Fault names the fault injected into the exchange, e.g. "status:503" or "reset".
+	Fault string `json:",omitempty"`
+	// Local is the file the response was served from by map local.
+	Local string `json:",omitempty"`
+	// Mock is the key of the recorded response that answered in mock mode.
+	Mock string `json:",omitempty"`
+
+	// Client tells who sent the request, see ClientConfig.
+	Client string `json:",omitempty"`
+	// User is the proxy user the client authenticated as, see AuthConfig.UsersFile.
+	User string `json:",omitempty"`
+
+	// fault is the injected rule, its response side is applied when the body is written.
+	fault *FaultRule
+}
+
+// RecordTunnel is a CONNECT relayed without MITM.
+type RecordTunnel struct {
+	SNI                 string
+	BytesClientToServer int64
+	BytesServerToClient int64
+	Duration            time.Duration
 }
 
 type _recordList struct {
 	mtx  sync.Mutex
-	data []_record
+	data []Record
 }
 
 func newRecordList() _recordList {
 	return _recordList{
-		data: make([]_record, 0),
+		data: make([]Record, 0),
 	}
 }
 
-func (l *_recordList) BuildHandler() func(writer http.ResponseWriter, _ *http.Request) {
-	return func(writer http.ResponseWriter, _ *http.Request) {
+func (l *_recordList) BuildHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
 		writer.Header().Add("content-type", "application/json")
 		writer.Header().Add("content-type", "charset=utf8")
 		writer.WriteHeader(http.StatusOK)
-		j, _ := json.Marshal(l.data)
+		j, _ := json.Marshal(l.snapshotOf(scope(req)))
 		log.Debug("==%s", string(j))
 		_, err := writer.Write(j)
 		if err != nil {
@@ -142,15 +248,117 @@ func (l *_recordList) BuildHandler() func(writer http.ResponseWriter, _ *http.Re
 	}
 }
 
-func (l *_recordList) BuildCleanHandler() func(writer http.ResponseWriter, _ *http.Request) {
-	return func(writer http.ResponseWriter, _ *http.Request) {
+// History returns a copy of the recorded exchanges, oldest first.
+func (d *Digger) History() []Record {
+	return d.history.snapshot()
+}
+
+// snapshot copies the records out of l.
+func (l *_recordList) snapshot() []Record {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	records := make([]Record, len(l.data))
+	copy(records, l.data)
+	return records
+}
+
+// snapshotOf copies the records of client out of l, all of them for "".
+func (l *_recordList) snapshotOf(client string) []Record {
+	if client == "" {
+		return l.snapshot()
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	records := make([]Record, 0)
+	for _, r := range l.data {
+		if r.Client == client {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// clean drops the records of client, all of them for "".
+func (l *_recordList) clean(client string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if client == "" {
 		l.data = l.data[0:0]
+		return
+	}
+	kept := l.data[:0]
+	for _, r := range l.data {
+		if r.Client != client {
+			kept = append(kept, r)
+		}
+	}
+	l.data = kept
+}
+
+func (l *_recordList) BuildCleanHandler(scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		l.clean(scope(req))
 		writer.WriteHeader(http.StatusOK)
 		return
 	}
 }
 
-func (l *_recordList) Add(r _record) {
+// URL is the absolute URL of the request, also for requests read inside a MITM tunnel.
+func (r *Record) URL() string {
+	u := *r.Req.URL
+	if u.Host == "" {
+		u.Host = r.Req.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.IsHttps {
+			u.Scheme = "https"
+		}
+	}
+	return u.String()
+}
+
+// addRecord fills the parsed views of r and appends it to the history.
+func (d *Digger) addRecord(record Record) {
+	// req never nil
+	_req, err := http.NewRequest(record.Req.Method, record.Req.URL.String(), bytes.NewReader(record.Req.BodyOrigin))
+	if err != nil {
+		log.Error("NewRequest fail: %s", err.Error())
+	} else {
+		err = _req.ParseForm()
+		if err != nil {
+			log.Error("ParseForm fail: %s", err.Error())
+		}
+		record.Req.Form = _req.Form
+	}
+	if record.Resp != nil {
+		record.Resp.fillBody()
+	}
+	// bodies are mostly forwarded unchanged, keep one copy then
+	if record.UpstreamReq != nil && bytes.Equal(record.UpstreamReq.BodyOrigin, record.Req.BodyOrigin) {
+		record.UpstreamReq.BodyOrigin = record.Req.BodyOrigin
+	}
+	if record.UpstreamResp != nil {
+		if record.Resp != nil && bytes.Equal(record.UpstreamResp.BodyOrigin, record.Resp.BodyOrigin) {
+			record.UpstreamResp.BodyOrigin = record.Resp.BodyOrigin
+		}
+		record.UpstreamResp.fillBody()
+	}
+	record.buildWaterfall()
+	d.observe(&record)
+	d.history.Add(record)
+	for _, h := range d.hooks {
+		h.OnRecord(record)
+	}
+}
+
+func (l *_recordList) Len() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return len(l.data)
+}
+
+func (l *_recordList) Add(r Record) {
 	l.mtx.Lock()
 	defer l.mtx.Unlock()
 	l.data = append(l.data, r)
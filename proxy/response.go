@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/er1c-zh/go-now/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newResponse builds a response digger answers with itself instead of asking upstream.
+func newResponse(req *http.Request, statusCode int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func newTextResponse(req *http.Request, statusCode int, text string) *http.Response {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return newResponse(req, statusCode, header, []byte(text))
+}
+
+// localResponse answers req without upstream when a rule says so,
+// hooks come first, then faults, map local and mock.
+// A nil result means the request goes on to upstream.
+func (d *Digger) localResponse(req *http.Request, record *Record) *http.Response {
+	resp := answerMaxForwards(req)
+	if resp != nil {
+		return d.answeredLocally(req, record, resp)
+	}
+	for _, h := range d.hooks {
+		if resp = h.OnRequest(req); resp != nil {
+			if resp.Request == nil {
+				resp.Request = req
+			}
+			return d.answeredLocally(req, record, resp)
+		}
+	}
+	if fault := d.faults.pick(req, record.Client); fault != nil {
+		record.Fault = fault.String()
+		log.Info("inject fault %s into %s", record.Fault, req.URL.String())
+		resp = fault.beforeUpstream(req)
+		record.fault = fault
+	}
+	if resp == nil {
+		if file, rule := d.mapLocal.lookup(req, record.Client); rule != nil {
+			record.Local = file
+			resp = rule.response(req, file)
+		}
+	}
+	if resp == nil {
+		resp = d.mock.respond(req, record)
+	}
+	if resp != nil {
+		return d.answeredLocally(req, record, resp)
+	}
+	return nil
+}
+
+func (d *Digger) answeredLocally(req *http.Request, record *Record, resp *http.Response) *http.Response {
+	// the client's body is still recorded and must be consumed for keep-alive
+	_, _ = io.Copy(ioutil.Discard, req.Body)
+	record.TimeReqFinish = time.Now()
+	return resp
+}
+
+// prepareResponse applies response rules to resp before it is written to the client.
+func (d *Digger) prepareResponse(resp *http.Response, record *Record) {
+	for _, h := range d.hooks {
+		h.OnResponse(resp)
+	}
+	if record.fault != nil {
+		record.fault.wrapResponse(resp)
+	}
+}
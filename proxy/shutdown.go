@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/er1c-zh/go-now/log"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout bounds GracefullyQuit.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// closedConnGrace is how long shutdown waits for conns it closed to finish.
+const closedConnGrace = time.Second
+
+// hijackTracker keeps the client conns taken over from http.Server,
+// which does not wait for them on Shutdown.
+type hijackTracker struct {
+	mtx sync.Mutex
+	// conns maps to true while an exchange is in flight
+	conns   map[net.Conn]bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// add tracks c as busy, false if shutting down and c should be dropped.
+func (t *hijackTracker) add(c net.Conn) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closing {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = map[net.Conn]bool{}
+	}
+	t.conns[c] = true
+	t.wg.Add(1)
+	return true
+}
+
+func (t *hijackTracker) remove(c net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.conns[c]; ok {
+		delete(t.conns, c)
+		t.wg.Done()
+	}
+}
+
+// idle marks c as waiting for the next request, false if shutting down and c should be closed.
+func (t *hijackTracker) idle(c net.Conn) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[c] = false
+	return true
+}
+
+func (t *hijackTracker) busy(c net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.conns[c]; ok {
+		t.conns[c] = true
+	}
+}
+
+// closeIdle stops taking conns and closes the ones waiting for a request.
+func (t *hijackTracker) closeIdle() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.closing = true
+	for c, busy := range t.conns {
+		if !busy {
+			_ = c.Close()
+		}
+	}
+}
+
+// wait blocks until every conn is done, the rest are closed when ctx is done first.
+func (t *hijackTracker) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.mtx.Lock()
+		log.Warn("close %d busy conns on shutdown", len(t.conns))
+		for c := range t.conns {
+			_ = c.Close()
+		}
+		t.mtx.Unlock()
+		// the closed conns still add their records
+		select {
+		case <-done:
+		case <-time.After(closedConnGrace):
+		}
+		return ctx.Err()
+	}
+}
+
+// flushHistory writes the history to HistoryFile, it can be loaded again as a mock Session.
+func (d *Digger) flushHistory() error {
+	if d.HistoryFile == "" {
+		return nil
+	}
+	j, err := json.Marshal(d.history.snapshot())
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(d.HistoryFile), 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(d.HistoryFile, j, 0644); err != nil {
+		return err
+	}
+	log.Info("history written to %s", d.HistoryFile)
+	return nil
+}
@@ -2,21 +2,25 @@ package proxy
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/er1c-zh/go-now/log"
 	"net/http"
 	"sync/atomic"
-	"time"
 )
 
-type statistics struct {
+// Statistics are counters of a running Digger.
+type Statistics struct {
 	CurrentConnCnt int64
+	CertCacheHit   int64
+	CertCacheMiss  int64
+	// UpstreamRetries are requests sent again after a reused upstream conn broke.
+	UpstreamRetries int64
+	Pool            PoolStats
 }
 
-func (s *statistics) BuildHandler() func(writer http.ResponseWriter, _ *http.Request) {
+func (d *Digger) BuildStatisticsHandler() func(writer http.ResponseWriter, _ *http.Request) {
 	return func(writer http.ResponseWriter, _ *http.Request) {
 		writer.WriteHeader(http.StatusOK)
-		j, _ := json.Marshal(s)
+		j, _ := json.Marshal(d.Statistics())
 		_, err := writer.Write(j)
 		if err != nil {
 			log.Error("statistics write to writer fail: %s", err.Error())
@@ -26,23 +30,30 @@ func (s *statistics) BuildHandler() func(writer http.ResponseWriter, _ *http.Req
 	}
 }
 
+// Statistics returns a snapshot of the counters.
+func (d *Digger) Statistics() Statistics {
+	return Statistics{
+		CurrentConnCnt: atomic.LoadInt64(&d.s.CurrentConnCnt),
+		CertCacheHit:   atomic.LoadInt64(&d.s.CertCacheHit),
+		CertCacheMiss:  atomic.LoadInt64(&d.s.CertCacheMiss),
+
+		UpstreamRetries: atomic.LoadInt64(&d.s.UpstreamRetries),
+		Pool:            DefaultConnPool.Stats(),
+	}
+}
+
+// GetStatisticsInfo returns the summary line, the counts are since the last one.
+//
+// Deprecated: /metrics and Summary replace it.
 func (d *Digger) GetStatisticsInfo() string {
-	return fmt.Sprintf("[s]current connect: %d", d.s.CurrentConnCnt)
+	return d.summary()
 }
 
+// LogStatisticsInfoPerSecond logs the summary line every Summary.IntervalSec.
+//
+// Deprecated: use LogSummary.
 func (d *Digger) LogStatisticsInfoPerSecond() {
-	go func() {
-		t := time.NewTicker(time.Second)
-		for {
-			select {
-			case <-t.C:
-				log.Info("%s", d.GetStatisticsInfo())
-			case <-d.done:
-				t.Stop()
-				return
-			}
-		}
-	}()
+	d.LogSummary()
 }
 
 func (d *Digger) AddCurConn() {
@@ -52,3 +63,15 @@ func (d *Digger) AddCurConn() {
 func (d *Digger) MinusCurConn() {
 	atomic.AddInt64(&d.s.CurrentConnCnt, -1)
 }
+
+func (d *Digger) AddCertCacheHit() {
+	atomic.AddInt64(&d.s.CertCacheHit, 1)
+}
+
+func (d *Digger) AddCertCacheMiss() {
+	atomic.AddInt64(&d.s.CertCacheMiss, 1)
+}
+
+func (d *Digger) AddUpstreamRetry() {
+	atomic.AddInt64(&d.s.UpstreamRetries, 1)
+}
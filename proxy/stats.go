@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/er1c-zh/go-now/log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// StatsByHost groups records by host, StatsByEndpoint by method and templated path,
+	// StatsByStatus by response status.
+	StatsByHost     = "hosts"
+	StatsByEndpoint = "endpoints"
+	StatsByStatus   = "status"
+
+	defaultStatsTop = 3
+)
+
+// TrafficStats aggregate the records of one group in /stats/*.
+// Tunnels are left out, digger cannot see into them.
+type TrafficStats struct {
+	// Key is the host, "METHOD host/templated/path" or the status, "error" without a response.
+	Key       string
+	Count     int
+	Errors    int
+	ErrorRate float64
+	// LatencyMs is from the request to the end of the response.
+	LatencyMs    Distribution
+	RequestSize  Distribution
+	ResponseSize Distribution
+	// Largest are the records with the largest response bodies, Slowest those that took longest.
+	Largest []StatsRecord
+	Slowest []StatsRecord
+}
+
+// Distribution summarizes the values of a group, sizes are body bytes.
+type Distribution struct {
+	P50 float64
+	P95 float64
+	P99 float64
+	Max float64
+	Sum float64
+}
+
+// StatsRecord points at a record in /history.
+type StatsRecord struct {
+	Index     int
+	URL       string
+	Status    int `json:",omitempty"`
+	LatencyMs float64
+	Bytes     int
+}
+
+// failed tells if the exchange ended in an error or a 5xx.
+func (r *Record) failed() bool {
+	return r.Error != "" || (r.Resp == nil && r.Tunnel == nil) || (r.Resp != nil && r.Resp.StatusCode >= 500)
+}
+
+func (r *Record) latency() time.Duration {
+	if r.TimeRespFinish.IsZero() {
+		return 0
+	}
+	return r.TimeRespFinish.Sub(r.TimeStart)
+}
+
+// templatePath collapses path segments that look like IDs, so /users/123 and /users/456 group together.
+func templatePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		switch {
+		case s == "":
+		case isDigits(s):
+			segments[i] = "{id}"
+		case isUUID(s):
+			segments[i] = "{uuid}"
+		case len(s) >= 16 && isHex(s) && hasDigit(s):
+			segments[i] = "{hash}"
+		case len(s) >= 20 && hasDigit(s) && isToken(s):
+			segments[i] = "{token}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isDigits(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+func hasDigit(s string) bool {
+	return strings.ContainsAny(s, "0123456789")
+}
+
+func isHex(s string) bool {
+	return strings.Trim(strings.ToLower(s), "0123456789abcdef") == ""
+}
+
+// isToken matches random ids like base64url or ulid, the caller checks they are not a slug.
+func isToken(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return false
+			}
+		} else if !isHex(string(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// statsKey is the group of r in the grouping by.
+func statsKey(by string, r *Record) string {
+	switch by {
+	case StatsByHost:
+		return strings.ToLower(stripPort(r.Req.Host))
+	case StatsByEndpoint:
+		p := ""
+		if r.Req.URL != nil {
+			p = templatePath(r.Req.URL.Path)
+		}
+		return r.Req.Method + " " + strings.ToLower(stripPort(r.Req.Host)) + p
+	default:
+		if r.Resp == nil {
+			return "error"
+		}
+		return strconv.Itoa(r.Resp.StatusCode)
+	}
+}
+
+// distribution takes the nearest-rank percentiles of values.
+func distribution(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sort.Float64s(values)
+	rank := func(p float64) float64 {
+		return values[int(math.Ceil(p*float64(len(values))))-1]
+	}
+	d := Distribution{P50: rank(.5), P95: rank(.95), P99: rank(.99), Max: values[len(values)-1]}
+	for _, v := range values {
+		d.Sum += v
+	}
+	return d
+}
+
+// aggregate groups records by and keeps the top largest and slowest records of each group.
+func aggregate(records []Record, by string, top int) []TrafficStats {
+	type group struct {
+		stats                         TrafficStats
+		latencies, reqSizes, respSize []float64
+		refs                          []StatsRecord
+	}
+	groups := map[string]*group{}
+	for i := range records {
+		r := &records[i]
+		if r.Req == nil || r.Tunnel != nil {
+			continue
+		}
+		key := statsKey(by, r)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{stats: TrafficStats{Key: key}}
+			groups[key] = g
+		}
+		g.stats.Count++
+		if r.failed() {
+			g.stats.Errors++
+		}
+		ref := StatsRecord{Index: i, URL: r.URL()}
+		g.reqSizes = append(g.reqSizes, float64(len(r.Req.BodyOrigin)))
+		if r.Resp != nil {
+			ref.Status = r.Resp.StatusCode
+			ref.Bytes = len(r.Resp.BodyOrigin)
+			g.respSize = append(g.respSize, float64(ref.Bytes))
+		}
+		if l := r.latency(); l > 0 {
+			ref.LatencyMs = float64(l) / float64(time.Millisecond)
+			g.latencies = append(g.latencies, ref.LatencyMs)
+		}
+		g.refs = append(g.refs, ref)
+	}
+
+	stats := make([]TrafficStats, 0, len(groups))
+	for _, g := range groups {
+		s := g.stats
+		s.ErrorRate = float64(s.Errors) / float64(s.Count)
+		s.LatencyMs = distribution(g.latencies)
+		s.RequestSize = distribution(g.reqSizes)
+		s.ResponseSize = distribution(g.respSize)
+		s.Largest = topRecords(g.refs, top, func(a, b StatsRecord) bool { return a.Bytes > b.Bytes })
+		s.Slowest = topRecords(g.refs, top, func(a, b StatsRecord) bool { return a.LatencyMs > b.LatencyMs })
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+func topRecords(refs []StatsRecord, top int, before func(a, b StatsRecord) bool) []StatsRecord {
+	sorted := append([]StatsRecord(nil), refs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return before(sorted[i], sorted[j])
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
+
+// BuildStatsHandler aggregates the history grouped by, ?top= sets how many
+// of the largest and slowest records each group lists.
+func (l *_recordList) BuildStatsHandler(by string, scope func(*http.Request) string) func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		top := defaultStatsTop
+		if v := req.URL.Query().Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte("invalid top " + v))
+				return
+			}
+			top = n
+		}
+		j, _ := json.Marshal(aggregate(l.snapshotOf(scope(req)), by, top))
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("stats write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTemplatePath(t *testing.T) {
+	for p, expect := range map[string]string{
+		"/users/123":        "/users/{id}",
+		"/users/456/orders": "/users/{id}/orders",
+		"/v2/items/550e8400-e29b-41d4-a716-446655440000": "/v2/items/{uuid}",
+		"/blobs/9f86d081884c7d659a2feaa0c55ad015":        "/blobs/{hash}",
+		"/s/01ARZ3NDEKTSV4RRFFQ69G5FAV":                  "/s/{token}",
+		"/blog/how-to-write-a-proxy-in-go":               "/blog/how-to-write-a-proxy-in-go",
+		"/":                                              "/",
+	} {
+		if got := templatePath(p); got != expect {
+			t.Errorf("templatePath(%s) got %s", p, got)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	start := time.Now()
+	record := func(host, path string, status int, ms int, size int) Record {
+		r := Record{
+			Req:            &RecordReq{Method: "GET", Host: host, URL: &url.URL{Scheme: "http", Host: host, Path: path}},
+			TimeStart:      start,
+			TimeRespFinish: start.Add(time.Duration(ms) * time.Millisecond),
+		}
+		if status > 0 {
+			r.Resp = &RecordResp{StatusCode: status, BodyOrigin: make([]byte, size)}
+		} else {
+			r.Error = "dial fail"
+		}
+		return r
+	}
+	var records []Record
+	for i := 1; i <= 100; i++ {
+		status := 200
+		if i%10 == 0 {
+			status = 503
+		}
+		records = append(records, record("api.example.com", "/users/"+strconv.Itoa(i), status, i, i*10))
+	}
+	records = append(records,
+		record("api.example.com", "/users/7/orders", 200, 5, 1),
+		record("cdn.example.com:443", "/a.js", 0, 0, 0),
+		Record{Req: &RecordReq{Method: "CONNECT", Host: "tunnel.com:443"}, Tunnel: &RecordTunnel{}},
+	)
+
+	hosts := aggregate(records, StatsByHost, 2)
+	if len(hosts) != 2 || hosts[0].Key != "api.example.com" || hosts[0].Count != 101 {
+		t.Fatalf("unexpected hosts %+v", hosts)
+	}
+	api := hosts[0]
+	if api.Errors != 10 || api.LatencyMs.P50 != 50 || api.LatencyMs.P99 != 99 || api.LatencyMs.Max != 100 {
+		t.Errorf("unexpected api stats %+v", api)
+	}
+	if len(api.Slowest) != 2 || api.Slowest[0].LatencyMs != 100 || api.Largest[0].Bytes != 1000 {
+		t.Errorf("unexpected top records %+v %+v", api.Slowest, api.Largest)
+	}
+	if cdn := hosts[1]; cdn.Key != "cdn.example.com" || cdn.ErrorRate != 1 {
+		t.Errorf("unexpected cdn stats %+v", cdn)
+	}
+
+	endpoints := aggregate(records, StatsByEndpoint, 0)
+	keys := map[string]int{}
+	for _, s := range endpoints {
+		keys[s.Key] = s.Count
+	}
+	if keys["GET api.example.com/users/{id}"] != 100 || keys["GET api.example.com/users/{id}/orders"] != 1 {
+		t.Errorf("unexpected endpoints %v", keys)
+	}
+
+	status := aggregate(records, StatsByStatus, 0)
+	if len(status) != 3 || status[0].Key != "200" || status[1].Key != "503" || status[2].Key != "error" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
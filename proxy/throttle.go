@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/er1c-zh/go-now/log"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ThrottleProfile simulates a slow network, it applies to the client and the upstream leg.
+type ThrottleProfile struct {
+	// DownKbps and UpKbps cap bandwidth towards and from the client on each leg, 0 is unlimited.
+	DownKbps int
+	UpKbps   int
+	// LatencyMs delays every response before its first byte reaches the client,
+	// half of it on each leg.
+	LatencyMs int
+	// ResetRate is the chance per read or write that the connection is reset.
+	ResetRate float64
+	// StallRate is the chance per read or write that it hangs for StallMs.
+	StallRate float64
+	StallMs   int
+}
+
+// ThrottleRule applies Profile to matching hosts, a rule without hosts matches every host.
+type ThrottleRule struct {
+	Hosts   []string
+	Profile string
+}
+
+// builtinThrottleProfiles follow the network link conditioner presets.
+var builtinThrottleProfiles = map[string]ThrottleProfile{
+	"edge":    {DownKbps: 240, UpKbps: 200, LatencyMs: 400},
+	"3g":      {DownKbps: 780, UpKbps: 330, LatencyMs: 100},
+	"slow-3g": {DownKbps: 400, UpKbps: 400, LatencyMs: 2000},
+	"lte":     {DownKbps: 50000, UpKbps: 10000, LatencyMs: 50},
+	"lossy":   {DownKbps: 780, UpKbps: 330, LatencyMs: 100, ResetRate: 0.01, StallRate: 0.05, StallMs: 3000},
+}
+
+var errThrottleReset = errors.New("connection reset by throttle")
+
+const throttleChunk = 1024
+
+type throttle struct {
+	mtx      sync.Mutex
+	rules    []ThrottleRule
+	profiles map[string]ThrottleProfile
+}
+
+func (t *throttle) init(rules []ThrottleRule, custom map[string]ThrottleProfile) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.profiles = map[string]ThrottleProfile{}
+	for name, p := range builtinThrottleProfiles {
+		t.profiles[name] = p
+	}
+	for name, p := range custom {
+		t.profiles[name] = p
+	}
+	t.rules = rules
+}
+
+// profileFor returns the profile of host, nil if it is not throttled.
+func (t *throttle) profileFor(host string) *ThrottleProfile {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, rule := range t.rules {
+		if len(rule.Hosts) > 0 && !hostPatterns(rule.Hosts).Match(host) {
+			continue
+		}
+		p, ok := t.profiles[rule.Profile]
+		if !ok {
+			log.Warn("throttle profile %s not found", rule.Profile)
+			return nil
+		}
+		return &p
+	}
+	return nil
+}
+
+// BuildHandler shows the throttle state on GET and replaces it on POST
+// with {"Rules": [...], "Profiles": {...}}, Profiles are merged into the existing ones.
+func (t *throttle) BuildHandler() func(writer http.ResponseWriter, req *http.Request) {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				log.Error("read throttle body fail: %s", err.Error())
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var update struct {
+				Rules    []ThrottleRule
+				Profiles map[string]ThrottleProfile
+			}
+			if err = json.Unmarshal(body, &update); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			t.mtx.Lock()
+			for name, p := range update.Profiles {
+				t.profiles[name] = p
+			}
+			t.rules = update.Rules
+			t.mtx.Unlock()
+			log.Info("throttle rules updated: %d rules", len(update.Rules))
+		}
+		t.mtx.Lock()
+		j, _ := json.Marshal(map[string]interface{}{
+			"Rules":    t.rules,
+			"Profiles": t.profiles,
+		})
+		t.mtx.Unlock()
+		writer.Header().Set("content-type", "application/json; charset=utf-8")
+		writer.WriteHeader(http.StatusOK)
+		_, err := writer.Write(j)
+		if err != nil {
+			log.Error("throttle write to writer fail: %s", err.Error())
+			return
+		}
+	}
+}
+
+type clientConnKey struct{}
+
+// withClientConn keeps the accepted conn in the request context,
+// so the handler can set its throttle profile once the host is known.
+func withClientConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, c)
+}
+
+// throttleUpstream is the profile for the upstream conn of req.
+func (d *Digger) throttleUpstream(req *http.Request) *ThrottleProfile {
+	return d.throttle.profileFor(stripPort(req.Host))
+}
+
+func (d *Digger) throttleClient(req *http.Request) {
+	c, ok := req.Context().Value(clientConnKey{}).(*throttledConn)
+	if !ok {
+		return
+	}
+	c.SetProfile(d.throttle.profileFor(stripPort(req.Host)))
+}
+
+type throttleListener struct {
+	net.Listener
+}
+
+func (l *throttleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &throttledConn{Conn: c}, nil
+}
+
+// throttledConn is a client conn, writes go down to the client and reads come up from it.
+// An upstream conn has it the other way round, writes go up to the server and reads come down.
+type throttledConn struct {
+	net.Conn
+	upstream bool
+
+	mtx     sync.Mutex
+	profile *ThrottleProfile
+	// wrote tells the direction of the last transfer, used if there was one
+	wrote bool
+	used  bool
+	// downFree and upFree are when each direction may send the next byte.
+	downFree time.Time
+	upFree   time.Time
+}
+
+func (c *throttledConn) SetProfile(p *ThrottleProfile) {
+	c.mtx.Lock()
+	c.profile = p
+	c.mtx.Unlock()
+}
+
+func (c *throttledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *throttledConn) getProfile() *ThrottleProfile {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.profile
+}
+
+// link returns the bandwidth and the booking of the direction of a write or a read.
+func (c *throttledConn) link(p *ThrottleProfile, write bool) (int, *time.Time) {
+	if write != c.upstream {
+		return p.DownKbps, &c.downFree
+	}
+	return p.UpKbps, &c.upFree
+}
+
+// turn records a transfer and tells if it goes the other way than the last one.
+func (c *throttledConn) turn(write bool) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	turned := c.used && c.wrote != write
+	c.wrote, c.used = write, true
+	return turned
+}
+
+// latency is the share of LatencyMs each leg adds to a response, the client leg
+// before writing it and the upstream leg after reading its first bytes.
+func latency(p *ThrottleProfile) time.Duration {
+	return time.Duration(p.LatencyMs) * time.Millisecond / 2
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	p := c.getProfile()
+	if p == nil {
+		return c.Conn.Read(b)
+	}
+	if err := c.chaos(p); err != nil {
+		return 0, err
+	}
+	kbps, free := c.link(p, false)
+	if kbps > 0 && len(b) > throttleChunk {
+		b = b[:throttleChunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.turn(false) && c.upstream {
+			time.Sleep(latency(p))
+		}
+		c.mtx.Lock()
+		wait := pace(free, n, kbps)
+		c.mtx.Unlock()
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	p := c.getProfile()
+	if p == nil {
+		return c.Conn.Write(b)
+	}
+	if c.turn(true) && !c.upstream {
+		time.Sleep(latency(p))
+	}
+	kbps, free := c.link(p, true)
+	written := 0
+	for written < len(b) {
+		if err := c.chaos(p); err != nil {
+			return written, err
+		}
+		end := len(b)
+		if kbps > 0 && end-written > throttleChunk {
+			end = written + throttleChunk
+		}
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		c.mtx.Lock()
+		wait := pace(free, n, kbps)
+		c.mtx.Unlock()
+		time.Sleep(wait)
+	}
+	return written, nil
+}
+
+// chaos randomly stalls or resets the connection.
+func (c *throttledConn) chaos(p *ThrottleProfile) error {
+	if p.StallRate > 0 && rand.Float64() < p.StallRate {
+		time.Sleep(time.Duration(p.StallMs) * time.Millisecond)
+	}
+	if p.ResetRate > 0 && rand.Float64() < p.ResetRate {
+		if tcp, ok := c.Conn.(*net.TCPConn); ok {
+			// linger 0 makes Close send RST instead of FIN
+			_ = tcp.SetLinger(0)
+		}
+		_ = c.Conn.Close()
+		return errThrottleReset
+	}
+	return nil
+}
+
+// pace books n bytes on a link of kbps and returns how long to wait for them.
+func pace(free *time.Time, n, kbps int) time.Duration {
+	if kbps <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if free.Before(now) {
+		*free = now
+	}
+	*free = free.Add(time.Duration(n) * 8 * time.Millisecond / time.Duration(kbps))
+	return free.Sub(now)
+}
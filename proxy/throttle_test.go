@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnPool_ThrottleUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 1000)
+		for {
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			if _, err := c.Write(make([]byte, 2000)); err != nil {
+				return
+			}
+		}
+	}()
+
+	pool := NewConnPool()
+	defer pool.Close()
+	profile := &ThrottleProfile{UpKbps: 80, DownKbps: 160, LatencyMs: 200}
+	action := ConnAction{URL: &url.URL{Scheme: "http", Host: l.Addr().String()}, Throttle: profile}
+	conn, err := pool.GetOrCreate(action)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1000 bytes up at 80kbps take 100ms
+	start := time.Now()
+	if _, err = conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("expect the write upstream to be paced, took %s", d)
+	}
+	// 2000 bytes down at 160kbps take 100ms, after half of the latency
+	start = time.Now()
+	if _, err = io.ReadFull(conn, make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Errorf("expect the read from upstream to be paced and delayed, took %s", d)
+	}
+
+	// a reused conn follows the profile of the new action
+	pool.Put(conn)
+	if conn, err = pool.GetOrCreate(ConnAction{URL: action.URL}); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start = time.Now()
+	if _, err = conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expect an unthrottled conn, took %s", d)
+	}
+}
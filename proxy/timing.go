@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"time"
+)
+
+// DialTiming is how an upstream conn was established, zero fields didn't happen,
+// e.g. there is no DNS phase when dialing an IP.
+type DialTiming struct {
+	DNSStart     time.Time
+	DNSDone      time.Time
+	ConnectStart time.Time
+	ConnectDone  time.Time
+	TLSStart     time.Time
+	TLSDone      time.Time
+}
+
+// RecordTiming is when each step of an exchange happened.
+type RecordTiming struct {
+	// Reused is true if the upstream conn served an earlier request, Dial is nil then.
+	// A conn dialed before the request was read keeps its Dial, but the dial is no phase of it.
+	Reused bool
+	Dial   *DialTiming `json:",omitempty"`
+	// ConnReady is when the upstream conn was ready to take the request.
+	ConnReady time.Time
+	FirstByte time.Time
+	// Phases is the waterfall, filled when the record is added to the history.
+	Phases []TimingPhase
+}
+
+// TimingPhase is one bar of the waterfall.
+type TimingPhase struct {
+	Name string
+	// Start is relative to Record.TimeStart.
+	Start    time.Duration
+	Duration time.Duration
+}
+
+const (
+	phaseBlocked = "blocked"
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseSend    = "send"
+	phaseWait    = "wait"
+	phaseReceive = "receive"
+)
+
+func (r *Record) buildWaterfall() {
+	t := r.Timing
+	if t == nil {
+		return
+	}
+	t.Phases = t.Phases[:0]
+	add := func(name string, start, end time.Time) {
+		if start.IsZero() || end.IsZero() || end.Before(start) {
+			return
+		}
+		t.Phases = append(t.Phases, TimingPhase{
+			Name:     name,
+			Start:    start.Sub(r.TimeStart),
+			Duration: end.Sub(start),
+		})
+	}
+	if d := t.Dial; d != nil && !d.start().Before(r.TimeStart) {
+		add(phaseBlocked, r.TimeStart, d.start())
+		add(phaseDNS, d.DNSStart, d.DNSDone)
+		add(phaseConnect, d.ConnectStart, d.ConnectDone)
+		add(phaseTLS, d.TLSStart, d.TLSDone)
+	} else {
+		add(phaseBlocked, r.TimeStart, t.ConnReady)
+	}
+	add(phaseSend, t.ConnReady, r.TimeReqFinish)
+	add(phaseWait, r.TimeReqFinish, t.FirstByte)
+	add(phaseReceive, t.FirstByte, r.TimeRespFinish)
+}
+
+// phase returns the duration of the named phase, -1 if it didn't happen.
+func (t *RecordTiming) phase(name string) time.Duration {
+	if t == nil {
+		return -1
+	}
+	for _, p := range t.Phases {
+		if p.Name == name {
+			return p.Duration
+		}
+	}
+	return -1
+}
+
+// start returns when dialing began.
+func (t *DialTiming) start() time.Time {
+	if !t.DNSStart.IsZero() {
+		return t.DNSStart
+	}
+	return t.ConnectStart
+}
+
+// startTiming starts the timing of a request sent on conn.
+// TimeStart stays when the request was read, so the latency of the record is the client's.
+func (r *Record) startTiming(conn interface{}) {
+	t := &RecordTiming{
+		Reused:    true,
+		ConnReady: time.Now(),
+	}
+	if store, ok := conn.(connectionStore); ok {
+		if t.Dial = store.TakeDialTiming(); t.Dial != nil {
+			t.Reused = false
+		}
+	}
+	r.Timing = t
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecord_BuildWaterfall(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	for name, c := range map[string]struct {
+		dial   *DialTiming
+		expect []string
+	}{
+		"dialed for the request": {
+			dial:   &DialTiming{DNSStart: at(1), DNSDone: at(2), ConnectStart: at(2), ConnectDone: at(3)},
+			expect: []string{phaseBlocked, phaseDNS, phaseConnect, phaseSend, phaseWait, phaseReceive},
+		},
+		"dialed before the request": {
+			dial:   &DialTiming{ConnectStart: at(-50), ConnectDone: at(-40)},
+			expect: []string{phaseBlocked, phaseSend, phaseWait, phaseReceive},
+		},
+	} {
+		r := &Record{TimeStart: start}
+		r.startTiming(&c8n{timing: c.dial, fresh: true})
+		if !r.TimeStart.Equal(start) || r.Timing.Reused {
+			t.Errorf("%s: expect TimeStart kept on a fresh conn, got %s", name, r.TimeStart.Sub(start))
+		}
+		r.Timing.ConnReady, r.TimeReqFinish, r.Timing.FirstByte, r.TimeRespFinish = at(4), at(5), at(6), at(7)
+		r.buildWaterfall()
+		var got []string
+		for _, p := range r.Timing.Phases {
+			if p.Start < 0 {
+				t.Errorf("%s: %s starts before the request", name, p.Name)
+			}
+			got = append(got, p.Name)
+		}
+		if len(got) != len(c.expect) {
+			t.Errorf("%s: got phases %v, expect %v", name, got, c.expect)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.expect[i] {
+				t.Errorf("%s: got phases %v, expect %v", name, got, c.expect)
+				break
+			}
+		}
+	}
+}
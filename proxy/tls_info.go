@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var tlsSessionID int64
+
+// alpnProtos are offered by digger on both legs, it only speaks HTTP/1.1.
+var alpnProtos = []string{"http/1.1"}
+
+// TLSSession is shared by the records of one MITM connection,
+// those sent upstream each have a copy with the upstream leg.
+type TLSSession struct {
+	ID       int64
+	Client   *TLSInfo
+	Upstream *TLSInfo `json:",omitempty"`
+}
+
+// TLSInfo describes one leg of a TLS session.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ALPN        string `json:",omitempty"`
+	SNI         string `json:",omitempty"`
+	DidResume   bool
+	// PeerCertificates is the chain presented by the other side, leaf first.
+	PeerCertificates []CertInfo `json:",omitempty"`
+}
+
+// CertInfo is the summary of a peer certificate.
+type CertInfo struct {
+	Subject      string
+	Issuer       string
+	SerialNumber string
+	DNSNames     []string `json:",omitempty"`
+	IPAddresses  []string `json:",omitempty"`
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+func newTLSSession(client *tls.Conn) *TLSSession {
+	state := client.ConnectionState()
+	return &TLSSession{
+		ID:     atomic.AddInt64(&tlsSessionID, 1),
+		Client: newTLSInfo(state, state.ServerName),
+	}
+}
+
+// via is s for a record sent upstream through conn.
+func (s *TLSSession) via(conn net.Conn) *TLSSession {
+	store, ok := conn.(connectionStore)
+	if !ok {
+		return s
+	}
+	c := *s
+	c.Upstream = store.GetTLSInfo()
+	return &c
+}
+
+func newTLSInfo(state tls.ConnectionState, sni string) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		SNI:         sni,
+		DidResume:   state.DidResume,
+	}
+	for _, cert := range state.PeerCertificates {
+		info.PeerCertificates = append(info.PeerCertificates, newCertInfo(cert))
+	}
+	return info
+}
+
+func newCertInfo(cert *x509.Certificate) CertInfo {
+	info := CertInfo{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.Text(16),
+		DNSNames:     cert.DNSNames,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(v), 16)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/er1c-zh/digger/util"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDigger_TLSSessionALPN(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer secure.Close()
+	d, stop := startTestDigger(t, WithUpstreamVerify(UpstreamVerifySkip))
+	defer stop()
+
+	proxyURL, _ := url.Parse("http://" + d.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(util.CA.Leaf)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}},
+	}}
+	resp, err := client.Get(secure.URL + "/alpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	// records of the MITM loop are added after the response is written
+	for i := 0; i < 100 && len(d.History()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	history := d.History()
+	if len(history) != 1 || history[0].TLS == nil || history[0].TLS.Upstream == nil {
+		t.Fatalf("expect one MITM record with both legs, got %+v", history)
+	}
+	if got := history[0].TLS.Client.ALPN; got != "http/1.1" {
+		t.Errorf("client ALPN got %q", got)
+	}
+	if got := history[0].TLS.Upstream.ALPN; got != "http/1.1" {
+		t.Errorf("upstream ALPN got %q", got)
+	}
+}
+
+func TestDigger_HttpsUpstreamFail(t *testing.T) {
+	d, stop := startTestDigger(t)
+	defer stop()
+
+	resp, err := newMITMClient(d).Get("https://down.invalid/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expect 502, got %d", resp.StatusCode)
+	}
+	for i := 0; i < 100 && len(d.History()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	history := d.History()
+	if len(history) != 1 || history[0].Error == "" || history[0].Resp == nil || history[0].Resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expect the failed dial recorded with its 502, got %+v", history)
+	}
+	if history[0].TLS == nil || history[0].TLS.Upstream != nil {
+		t.Errorf("expect only the client leg, got %+v", history[0].TLS)
+	}
+}
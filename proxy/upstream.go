@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bufio"
+	"github.com/er1c-zh/go-now/log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstream is the conn a handler sends its requests through,
+// it is replaced from DefaultConnPool when it breaks.
+type upstream struct {
+	action ConnAction
+	conn   net.Conn
+	r      *bufio.Reader
+}
+
+func (u *upstream) get() error {
+	if u.conn != nil {
+		return nil
+	}
+	conn, err := DefaultConnPool.GetOrCreate(u.action)
+	if err != nil {
+		return err
+	}
+	u.conn = conn
+	if br, ok := conn.(interface{ Reader() *bufio.Reader }); ok {
+		u.r = br.Reader()
+	} else {
+		u.r = bufio.NewReader(conn)
+	}
+	return nil
+}
+
+// release hands the conn back to the pool, a broken one is closed instead.
+func (u *upstream) release(broken bool) {
+	if u.conn == nil {
+		return
+	}
+	if broken {
+		_ = u.conn.Close()
+	}
+	DefaultConnPool.Put(u.conn)
+	u.conn = nil
+	u.r = nil
+}
+
+// roundTrip writes req upstream and reads the response head.
+// A reused conn that turns out stale is replaced and, if req is idempotent
+// and has no body to replay, req is sent once more.
+func (d *Digger) roundTrip(u *upstream, req *http.Request, record *Record) (*http.Response, error) {
+	d.prepareRequest(req, record)
+	for attempt := 0; ; attempt++ {
+		if err := u.get(); err != nil {
+			return nil, err
+		}
+		record.startTiming(u.conn)
+		var body *continueBody
+		if expectsContinue(req) {
+			// not retryable, there is a body
+			body = &continueBody{ReadCloser: req.Body, u: u, req: req}
+			req.Body = body
+		}
+		err := req.Write(u.conn)
+		if body != nil && body.final != nil {
+			record.TimeReqFinish = time.Now()
+			record.Timing.FirstByte = record.TimeReqFinish
+			record.UpstreamResp, _ = recordRespFromHttpResp(body.final)
+			d.prepareUpstreamResponse(body.final)
+			return body.final, nil
+		}
+		if err == nil {
+			record.TimeReqFinish = time.Now()
+			if _, err = u.r.Peek(1); err == nil {
+				record.Timing.FirstByte = time.Now()
+				resp, err := readResponse(u.r, req)
+				if err != nil {
+					u.release(true)
+					return nil, err
+				}
+				record.UpstreamResp, _ = recordRespFromHttpResp(resp)
+				d.prepareUpstreamResponse(resp)
+				return resp, nil
+			}
+		}
+		u.release(true)
+		if attempt > 0 || !record.Timing.Reused || !retryable(req) {
+			return nil, err
+		}
+		log.Warn("stale upstream conn to %s, retry: %s", u.action.URL.Host, err.Error())
+		d.AddUpstreamRetry()
+	}
+}
+
+// readResponse skips the interim 1xx responses, a late 100 Continue among them.
+func readResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil || !isInformational(resp.StatusCode) {
+			return resp, err
+		}
+	}
+}
+
+// retryable tells if req can be sent again, the body is gone after the first try.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.ContentLength == 0 && len(req.TransferEncoding) == 0
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// UpstreamVerifySystem verifies with the system roots plus the rule's CABundles.
+	UpstreamVerifySystem = "system"
+	// UpstreamVerifySkip accepts any server certificate.
+	UpstreamVerifySkip = "skip"
+)
+
+// UpstreamTLSRule configures the TLS client used towards matching hosts.
+type UpstreamTLSRule struct {
+	// Hosts are hostPatterns, a rule without hosts matches every host.
+	Hosts []string
+	// Verify is UpstreamVerifySystem or UpstreamVerifySkip, default is Digger.UpstreamVerify.
+	Verify string
+	// CABundles are PEM files trusted on top of the system roots, e.g. internal PKI.
+	CABundles []string
+	// ClientCert and ClientKey are a PEM pair presented for mTLS.
+	ClientCert string
+	ClientKey  string
+}
+
+type upstreamTLS struct {
+	hosts  hostPatterns
+	config *tls.Config
+}
+
+// buildUpstreamTLS compiles d.UpstreamTLS, loading every bundle and client certificate once.
+func (d *Digger) buildUpstreamTLS() error {
+	list := make([]upstreamTLS, 0, len(d.UpstreamTLS)+1)
+	for i, rule := range d.UpstreamTLS {
+		if rule.Verify == "" {
+			rule.Verify = d.UpstreamVerify
+		}
+		config, err := rule.build()
+		if err != nil {
+			return fmt.Errorf("UpstreamTLS[%d]: %s", i, err.Error())
+		}
+		config.KeyLogWriter = &d.keyLog
+		list = append(list, upstreamTLS{hosts: rule.Hosts, config: config})
+	}
+	config, err := UpstreamTLSRule{Verify: d.UpstreamVerify}.build()
+	if err != nil {
+		return fmt.Errorf("UpstreamVerify: %s", err.Error())
+	}
+	config.KeyLogWriter = &d.keyLog
+	d.upstreamTLS = append(list, upstreamTLS{config: config})
+	return nil
+}
+
+func (r UpstreamTLSRule) build() (*tls.Config, error) {
+	config := &tls.Config{}
+	switch r.Verify {
+	case UpstreamVerifySkip:
+		config.InsecureSkipVerify = true
+	case UpstreamVerifySystem, "":
+		if len(r.CABundles) > 0 {
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			for _, path := range r.CABundles {
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				if !pool.AppendCertsFromPEM(data) {
+					return nil, fmt.Errorf("no certificate found in %s", path)
+				}
+			}
+			config.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unknown verify mode %q", r.Verify)
+	}
+	if r.ClientCert != "" || r.ClientKey != "" {
+		if r.ClientCert == "" || r.ClientKey == "" {
+			return nil, errors.New("ClientCert and ClientKey must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(r.ClientCert, r.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// upstreamTLSConfig returns the TLS client config for host, the last entry always matches.
+func (d *Digger) upstreamTLSConfig(host string) *tls.Config {
+	for _, u := range d.upstreamTLS {
+		if len(u.hosts) == 0 || u.hosts.Match(host) {
+			return u.config
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/er1c-zh/go-now/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvHome   = "DIGGER_HOME"
+	EnvCACert = "DIGGER_CA_CERT"
+	EnvCAKey  = "DIGGER_CA_KEY"
+
+	CACertFileName = "ca.crt"
+	CAKeyFileName  = "ca.key"
+)
+
+// DefaultConfigDir is $DIGGER_HOME, or ~/.digger if it is not set.
+func DefaultConfigDir() string {
+	if dir := os.Getenv(EnvHome); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Warn("UserHomeDir fail: %s", err.Error())
+		return ".digger"
+	}
+	return filepath.Join(home, ".digger")
+}
+
+// CAPaths resolves where the root CA lives.
+// Explicit paths win over $DIGGER_CA_CERT / $DIGGER_CA_KEY, which win over dir.
+func CAPaths(dir, certPath, keyPath string) (string, string) {
+	if certPath == "" {
+		certPath = os.Getenv(EnvCACert)
+	}
+	if keyPath == "" {
+		keyPath = os.Getenv(EnvCAKey)
+	}
+	if dir == "" {
+		dir = DefaultConfigDir()
+	}
+	if certPath == "" {
+		certPath = filepath.Join(dir, CACertFileName)
+	}
+	if keyPath == "" {
+		keyPath = filepath.Join(dir, CAKeyFileName)
+	}
+	return certPath, keyPath
+}
+
+// SetCA makes cert the root CA used by SignHost.
+func SetCA(cert *Cert) error {
+	ca, err := tls.X509KeyPair(cert.Cert, cert.Private)
+	if err != nil {
+		return err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !ca.Leaf.IsCA || ca.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("certificate is not allowed to sign certificates")
+	}
+	switch ca.PrivateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return fmt.Errorf("unsupported CA key type %T, expect RSA or ECDSA", ca.PrivateKey)
+	}
+	CA = ca
+	return nil
+}
+
+// LoadCA reads a PEM certificate and its RSA or ECDSA key and makes them the root CA.
+func LoadCA(certPath, keyPath string) error {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	return SetCA(&Cert{Cert: certPEM, Private: keyPEM})
+}
+
+// LoadOrCreateCA loads the root CA, generating a unique one on first run.
+// A CA is only generated when neither file exists, never over a half-present pair.
+func LoadOrCreateCA(dir, certPath, keyPath string) error {
+	certPath, keyPath = CAPaths(dir, certPath, keyPath)
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Info("root CA not found, generate one to %s", certPath)
+		cert, err := GenerateCertificate()
+		if err != nil {
+			return err
+		}
+		if err = writeCA(cert, certPath, keyPath); err != nil {
+			return err
+		}
+		return SetCA(cert)
+	}
+	return LoadCA(certPath, keyPath)
+}
+
+// RotateCA replaces the root CA with a freshly generated one.
+// The previous pair is kept next to it with a timestamp suffix.
+func RotateCA(dir, certPath, keyPath string, keyType KeyType) error {
+	certPath, keyPath = CAPaths(dir, certPath, keyPath)
+	cert, err := GenerateCertificate(keyType)
+	if err != nil {
+		return err
+	}
+	suffix := "." + strconv.FormatInt(time.Now().Unix(), 10)
+	for _, p := range []string{certPath, keyPath} {
+		err = os.Rename(p, p+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = writeCA(cert, certPath, keyPath); err != nil {
+		return err
+	}
+	return SetCA(cert)
+}
+
+func writeCA(cert *Cert, certPath, keyPath string) error {
+	for _, p := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyPath, cert.Private, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, cert.Cert, 0644)
+}
+
+// CAFingerprint is the colon separated SHA-256 of the root CA certificate.
+func CAFingerprint() string {
+	if len(CA.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(CA.Certificate[0])
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	parts := make([]string, 0, len(sum))
+	for i := 0; i < len(h); i += 2 {
+		parts = append(parts, h[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
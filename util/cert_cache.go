@@ -0,0 +1,230 @@
+package util
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/er1c-zh/go-now/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCertCacheSize = 1024
+	// treat a certificate as expired a while before NotAfter,
+	// so clients never see one which expires mid-session.
+	certExpireMargin = 24 * time.Hour
+)
+
+// CertCache is a concurrency-safe LRU of MITM leaf certificates keyed by host.
+// Concurrent misses on the same host share one SignHost call.
+// If dir is not empty, certificates are persisted there and reused across runs.
+type CertCache struct {
+	mtx      sync.Mutex
+	capacity int
+	dir      string
+	ll       *list.List
+	items    map[string]*list.Element
+	inflight map[string]*certCall
+}
+
+type certCacheEntry struct {
+	host     string
+	cert     *tls.Certificate
+	expireAt time.Time
+}
+
+type certCall struct {
+	wg   sync.WaitGroup
+	cert *tls.Certificate
+	err  error
+}
+
+func NewCertCache(capacity int, dir string) *CertCache {
+	if capacity <= 0 {
+		capacity = DefaultCertCacheSize
+	}
+	return &CertCache{
+		capacity: capacity,
+		dir:      dir,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+		inflight: map[string]*certCall{},
+	}
+}
+
+// Get returns the certificate of host, hit reports whether it was served
+// without signing a new one.
+func (c *CertCache) Get(host string) (cert *tls.Certificate, hit bool, err error) {
+	c.mtx.Lock()
+	if e, ok := c.items[host]; ok {
+		entry := e.Value.(*certCacheEntry)
+		if time.Now().Before(entry.expireAt) {
+			c.ll.MoveToFront(e)
+			c.mtx.Unlock()
+			return entry.cert, true, nil
+		}
+		c.removeElement(e)
+	}
+	if call, ok := c.inflight[host]; ok {
+		c.mtx.Unlock()
+		call.wg.Wait()
+		return call.cert, call.err == nil, call.err
+	}
+	call := &certCall{}
+	call.wg.Add(1)
+	c.inflight[host] = call
+	c.mtx.Unlock()
+
+	call.cert, hit, call.err = c.load(host)
+
+	c.mtx.Lock()
+	delete(c.inflight, host)
+	if call.err == nil {
+		c.add(host, call.cert)
+	}
+	c.mtx.Unlock()
+	call.wg.Done()
+	return call.cert, hit, call.err
+}
+
+func (c *CertCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.ll.Len()
+}
+
+// Purge drops all cached certificates, e.g. after the CA changed.
+func (c *CertCache) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.ll.Init()
+	c.items = map[string]*list.Element{}
+}
+
+// load reads host's certificate from disk or signs a new one.
+func (c *CertCache) load(host string) (*tls.Certificate, bool, error) {
+	if cert := c.loadFromDisk(host); cert != nil {
+		return cert, true, nil
+	}
+	cert, err := SignHost([]string{host})
+	if err != nil {
+		return nil, false, err
+	}
+	c.saveToDisk(host, cert)
+	return cert, false, nil
+}
+
+func (c *CertCache) add(host string, cert *tls.Certificate) {
+	if e, ok := c.items[host]; ok {
+		c.removeElement(e)
+	}
+	expireAt := time.Now().Add(certExpireMargin)
+	if cert.Leaf != nil {
+		expireAt = cert.Leaf.NotAfter.Add(-certExpireMargin)
+	}
+	c.items[host] = c.ll.PushFront(&certCacheEntry{
+		host:     host,
+		cert:     cert,
+		expireAt: expireAt,
+	})
+	for c.ll.Len() > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *CertCache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*certCacheEntry).host)
+}
+
+func (c *CertCache) path(host string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, host)
+	return filepath.Join(c.dir, name+".pem")
+}
+
+func (c *CertCache) loadFromDisk(host string) *tls.Certificate {
+	if c.dir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.path(host))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("read cached cert of %s fail: %s", host, err.Error())
+		}
+		return nil
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		log.Warn("parse cached cert of %s fail: %s", host, err.Error())
+		return nil
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		log.Warn("parse cached cert of %s fail: %s", host, err.Error())
+		return nil
+	}
+	if err = cert.Leaf.VerifyHostname(host); err != nil {
+		return nil
+	}
+	if time.Now().After(cert.Leaf.NotAfter.Add(-certExpireMargin)) {
+		return nil
+	}
+	// signed by a CA we no longer use
+	if CA.Leaf == nil || cert.Leaf.CheckSignatureFrom(CA.Leaf) != nil {
+		return nil
+	}
+	return &cert
+}
+
+func (c *CertCache) saveToDisk(host string, cert *tls.Certificate) {
+	if c.dir == "" {
+		return
+	}
+	data, err := encodeCertPEM(cert)
+	if err != nil {
+		log.Warn("encode cert of %s fail: %s", host, err.Error())
+		return
+	}
+	if err = os.MkdirAll(c.dir, 0700); err != nil {
+		log.Warn("create cert cache dir fail: %s", err.Error())
+		return
+	}
+	if err = ioutil.WriteFile(c.path(host), data, 0600); err != nil {
+		log.Warn("write cached cert of %s fail: %s", host, err.Error())
+		return
+	}
+}
+
+func encodeCertPEM(cert *tls.Certificate) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	if cert.PrivateKey == nil {
+		return nil, errors.New("no private key")
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = pem.Encode(buf, &pem.Block{Type: "PRIVATE KEY", Bytes: key}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
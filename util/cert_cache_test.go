@@ -0,0 +1,86 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestCertCache_Get(t *testing.T) {
+	c := NewCertCache(2, "")
+	first, hit, err := c.Get("a.example.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if hit {
+		t.Error("first Get should miss")
+	}
+	second, hit, err := c.Get("a.example.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !hit || first != second {
+		t.Error("second Get should hit")
+	}
+
+	_, _, _ = c.Get("b.example.com")
+	_, _, _ = c.Get("c.example.com")
+	if c.Len() != 2 {
+		t.Errorf("expect 2 entries, got %d", c.Len())
+	}
+	if _, hit, _ = c.Get("a.example.com"); hit {
+		t.Error("a.example.com should be evicted")
+	}
+}
+
+func TestCertCache_Concurrent(t *testing.T) {
+	c := NewCertCache(0, "")
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	miss := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, hit, err := c.Get("concurrent.example.com")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !hit {
+				mtx.Lock()
+				miss++
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if miss != 1 {
+		t.Errorf("expect exactly 1 miss, got %d", miss)
+	}
+}
+
+func TestCertCache_Disk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digger-cert-cache")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err = NewCertCache(0, dir).Get("disk.example.com"); err != nil {
+		t.Error(err)
+		return
+	}
+	_, hit, err := NewCertCache(0, dir).Get("disk.example.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !hit {
+		t.Error("expect cert loaded from disk")
+	}
+}
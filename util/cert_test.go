@@ -1,6 +1,28 @@
 package util
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	cert, err := GenerateCertificate(KeyTypeECDSA)
+	if err != nil {
+		panic(err)
+	}
+	if err = SetCA(cert); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
 
 func TestGenerateCertificate(t *testing.T) {
 	cert, err := GenerateCertificate()
@@ -11,3 +33,75 @@ func TestGenerateCertificate(t *testing.T) {
 	t.Logf("cert: %s", string(cert.Cert))
 	t.Logf("private: %s", string(cert.Private))
 }
+
+func TestLoadOrCreateCA(t *testing.T) {
+	origin := CA
+	defer func() {
+		CA = origin
+	}()
+	dir, err := ioutil.TempDir("", "digger-ca")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err = LoadOrCreateCA(dir, "", ""); err != nil {
+		t.Error(err)
+		return
+	}
+	created := CAFingerprint()
+	if err = LoadOrCreateCA(dir, "", ""); err != nil {
+		t.Error(err)
+		return
+	}
+	if CAFingerprint() != created {
+		t.Error("expect the generated CA to be loaded again")
+	}
+	if err = RotateCA(dir, "", "", KeyTypeECDSA); err != nil {
+		t.Error(err)
+		return
+	}
+	if CAFingerprint() == created {
+		t.Error("expect a new CA after rotate")
+	}
+}
+
+func TestSetCA_UnsupportedKey(t *testing.T) {
+	pub, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ed25519 CA"},
+		NotBefore:             time.Now().AddDate(0, 0, -1),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkDER, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &Cert{
+		Cert:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Private: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkDER}),
+	}
+	origin := CA
+	if err = SetCA(cert); err == nil {
+		CA = origin
+		t.Fatal("expect an ed25519 CA to be rejected")
+	}
+	if CA.Leaf != origin.Leaf {
+		t.Error("expect the CA in use to be kept")
+	}
+	if _, err = SignHost([]string{"example.com"}); err != nil {
+		t.Errorf("expect the CA in use to still sign, got %v", err)
+	}
+}